@@ -0,0 +1,66 @@
+package searpc
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// SetBatchWorkers sets the maximum number of calls of a batch run
+// concurrently by CallBatch. If n <= 0, GOMAXPROCS is used, which is the
+// default. It must not be called concurrently with calls to the server.
+func (server *Server) SetBatchWorkers(n int) {
+	server.workers = n
+}
+
+// CallBatch invokes each of callStrs on the named service, as Call does, and
+// returns the results in the same order. The calls are run concurrently. A
+// call that panics gets an InternalServerError result, without affecting
+// the others.
+func (server *Server) CallBatch(serviceName string, callStrs [][]byte) [][]byte {
+	workers := server.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(callStrs) {
+		workers = len(callStrs)
+	}
+
+	retStrs := make([][]byte, len(callStrs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				retStrs[i] = server.batchCall(serviceName, callStrs, i)
+			}
+		}()
+	}
+	for i := range callStrs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return retStrs
+}
+
+// batchCall runs call i of a batch. Panics in functions are recovered by
+// invoke already; this also recovers those in interceptors or converters,
+// which would otherwise bring down every call of the batch.
+func (server *Server) batchCall(serviceName string, callStrs [][]byte, i int) (retStr []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			if server.onPanic != nil {
+				server.panicked(CallInfo{Service: serviceName, CallStr: callStrs[i]}, r, stack)
+			}
+			errStr := fmt.Sprintf("Call %d of batch panicked: %v", i, r)
+			server.logf("%s\n%s", errStr, stack)
+			retStr = server.encode(Result{ErrCode: int(InternalServerError), ErrMsg: errStr})
+		}
+	}()
+	return server.Call(serviceName, callStrs[i])
+}
@@ -0,0 +1,94 @@
+package searpc
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Client encodes function calls in the searpc wire format, the JSON array
+// [funcName, arg1, arg2, ...] that Server.Call expects. With a Transport, it
+// can also make the calls.
+type Client struct {
+	Transport Transport // used by Call
+}
+
+// Transport carries call strings to a server and brings back the results.
+type Transport interface {
+	Send(serviceName string, callStr []byte) (retStr []byte, err error)
+}
+
+// NewClient returns a client making calls through t.
+func NewClient(t Transport) *Client {
+	return &Client{Transport: t}
+}
+
+// Call calls funcName of the named service with args through the transport
+// of the client, and returns the decoded result. Use Result.Decode to get
+// the returned value as a specific type. If the result carries a non-zero
+// error code, it is also returned as an *RPCError.
+func (c *Client) Call(serviceName, funcName string, args ...interface{}) (Result, error) {
+	if c.Transport == nil {
+		return Result{}, errors.New("searpc: client has no transport")
+	}
+	callStr, err := c.EncodeCall(funcName, args...)
+	if err != nil {
+		return Result{}, err
+	}
+	retStr, err := c.Transport.Send(serviceName, callStr)
+	if err != nil {
+		return Result{}, err
+	}
+	var res Result
+	if err := json.Unmarshal(retStr, &res); err != nil {
+		return Result{}, err
+	}
+	if res.ErrCode != 0 {
+		return res, &RPCError{ErrCode: res.ErrCode, ErrMsg: res.ErrMsg}
+	}
+	return res, nil
+}
+
+// EncodeCall returns the call string for calling funcName with args.
+func (c *Client) EncodeCall(funcName string, args ...interface{}) ([]byte, error) {
+	array := make([]interface{}, 0, len(args)+1)
+	array = append(array, funcName)
+	array = append(array, args...)
+	return json.Marshal(array)
+}
+
+// DecodeResult parses a result string returned by Server.Call and stores the
+// returned value in out. If the result carries a non-zero error code, it is
+// returned as an *RPCError and out is left untouched. out may be nil if the
+// returned value is not needed.
+func DecodeResult(data []byte, out interface{}) error {
+	var res struct {
+		Ret     json.RawMessage `json:"ret"`
+		ErrCode int             `json:"err_code"`
+		ErrMsg  string          `json:"err_msg"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	if res.ErrCode != 0 {
+		return &RPCError{ErrCode: res.ErrCode, ErrMsg: res.ErrMsg}
+	}
+	if out == nil || len(res.Ret) == 0 {
+		return nil
+	}
+	return json.Unmarshal(res.Ret, out)
+}
+
+// Decode stores the returned value of r in out, converting it through JSON
+// so that out can be of any type Ret can be decoded to. If r carries a
+// non-zero error code, it is returned as an *RPCError and out is left
+// untouched.
+func (r Result) Decode(out interface{}) error {
+	if r.ErrCode != 0 {
+		return &RPCError{ErrCode: r.ErrCode, ErrMsg: r.ErrMsg}
+	}
+	data, err := json.Marshal(r.Ret)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,270 @@
+// Package codegen writes typed Go clients for the services of a
+// searpc.Server, with one method per function, calling it through a
+// searpc.Client.
+package codegen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	searpc "github.com/killing/searpc-go"
+)
+
+const searpcPath = "github.com/killing/searpc-go"
+
+var (
+	typeOfError       = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfResult      = reflect.TypeOf((*searpc.Result)(nil))
+	typeOfResultValue = typeOfResult.Elem()
+)
+
+// Generate writes to w the source of a Go file of package packageName,
+// declaring a client type for each service of server. For a service named
+// "repo", RepoClient has a method per function, taking the parameters of
+// the function, making the call and decoding the returned values. Function
+// "get_repo" gets:
+//
+//	func (c *RepoClient) GetRepo(arg0 string) (ret0 *repo.Repo, err error)
+//
+// Functions returning a Result or a *Result get a method returning the
+// decoded Result. Streaming functions and the names added by AliasFunc,
+// which can't be called with a single signature, are left out. An error is
+// returned if a type can't be written in Go source, such as a type of
+// package main, or if two names map to the same identifier.
+func Generate(server *searpc.Server, packageName string, w io.Writer) error {
+	g := &generator{imports: map[string]string{searpcPath: "searpc"}}
+	var body bytes.Buffer
+	for _, sname := range server.Services() {
+		if err := g.service(&body, server, sname); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by searpc codegen. DO NOT EDIT.\n\npackage %s\n\nimport (\n", packageName)
+	paths := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(&buf, "\t%s %q\n", g.imports[path], path)
+	}
+	buf.WriteString(")\n")
+	buf.Write(body.Bytes())
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("searpc/codegen: invalid source generated: %v", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+type generator struct {
+	imports map[string]string // package paths to names
+}
+
+// service writes the client type of the named service.
+func (g *generator) service(w *bytes.Buffer, server *searpc.Server, sname string) error {
+	tname := identifier(sname) + "Client"
+	if tname == "Client" {
+		return errors.New("searpc/codegen: no identifier for service " + sname)
+	}
+	methods, err := server.Methods(sname)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n// %s calls the functions of service %s.\ntype %s struct {\n\tClient *searpc.Client\n}\n", tname, sname, tname)
+
+	seen := make(map[string]string)
+	for _, mname := range methods {
+		ftype, err := server.FuncType(sname, mname)
+		if err != nil {
+			// An alias, whose functions may have different signatures.
+			continue
+		}
+		id := identifier(mname)
+		if id == "" {
+			return errors.New("searpc/codegen: no identifier for function " + mname + " of service " + sname)
+		}
+		if other, ok := seen[id]; ok {
+			return fmt.Errorf("searpc/codegen: functions %s and %s of service %s are both named %s", other, mname, sname, id)
+		}
+		seen[id] = mname
+		if err := g.method(w, tname, sname, mname, id, ftype); err != nil {
+			return fmt.Errorf("searpc/codegen: function %s of service %s: %v", mname, sname, err)
+		}
+	}
+	return nil
+}
+
+// method writes the client method calling function mname, of type ftype.
+func (g *generator) method(w *bytes.Buffer, tname, sname, mname, id string, ftype reflect.Type) error {
+	rets := make([]reflect.Type, ftype.NumOut())
+	for i := range rets {
+		rets[i] = ftype.Out(i)
+	}
+	if n := len(rets); n > 0 && rets[n-1] == typeOfError {
+		rets = rets[:n-1]
+	}
+	isResult := false
+	if len(rets) == 1 {
+		switch {
+		case rets[0].Kind() == reflect.Chan:
+			return nil
+		case rets[0] == typeOfResult || rets[0] == typeOfResultValue:
+			isResult = true
+		}
+	}
+
+	params := make([]string, ftype.NumIn())
+	args := make([]string, ftype.NumIn())
+	for i := range params {
+		typ := ftype.In(i)
+		prefix := ""
+		if i == len(params)-1 && ftype.IsVariadic() {
+			typ = typ.Elem()
+			prefix = "..."
+		}
+		ts, err := g.typeString(typ)
+		if err != nil {
+			return err
+		}
+		params[i] = fmt.Sprintf("arg%d %s%s", i, prefix, ts)
+		args[i] = fmt.Sprintf("arg%d", i)
+	}
+	fmt.Fprintf(w, "\n// %s calls %s.\nfunc (c *%s) %s(%s) ", id, mname, tname, id, strings.Join(params, ", "))
+	call := fmt.Sprintf("c.Client.Call(%q, %q", sname, mname)
+	pre := ""
+	if n := len(args); n > 0 && ftype.IsVariadic() {
+		// Spread the variadic arguments in the call.
+		var b strings.Builder
+		fmt.Fprintf(&b, "\targs := make([]interface{}, 0, %d+len(%s))\n", n-1, args[n-1])
+		if n > 1 {
+			fmt.Fprintf(&b, "\targs = append(args, %s)\n", strings.Join(args[:n-1], ", "))
+		}
+		fmt.Fprintf(&b, "\tfor _, a := range %s {\n\t\targs = append(args, a)\n\t}\n", args[n-1])
+		pre = b.String()
+		call += ", args...)"
+	} else if n > 0 {
+		call += ", " + strings.Join(args, ", ") + ")"
+	} else {
+		call += ")"
+	}
+	return g.results(w, pre, call, rets, isResult)
+}
+
+// results writes the results and the body of a client method, making call
+// after the statements of pre.
+func (g *generator) results(w *bytes.Buffer, pre, call string, rets []reflect.Type, isResult bool) error {
+	if isResult {
+		fmt.Fprintf(w, "(searpc.Result, error) {\n%s\treturn %s\n}\n", pre, call)
+		return nil
+	}
+	outs := make([]string, len(rets))
+	refs := make([]string, len(rets))
+	for i, typ := range rets {
+		ts, err := g.typeString(typ)
+		if err != nil {
+			return err
+		}
+		outs[i] = fmt.Sprintf("ret%d %s", i, ts)
+		refs[i] = fmt.Sprintf("&ret%d", i)
+	}
+	outs = append(outs, "err error")
+	fmt.Fprintf(w, "(%s) {\n%s", strings.Join(outs, ", "), pre)
+	switch len(rets) {
+	case 0:
+		fmt.Fprintf(w, "\t_, err = %s\n\treturn\n}\n", call)
+	case 1:
+		fmt.Fprintf(w, "\tres, err := %s\n\tif err != nil {\n\t\treturn\n\t}\n\terr = res.Decode(&ret0)\n\treturn\n}\n", call)
+	default:
+		// Several values are returned as an array, decoded in place.
+		fmt.Fprintf(w, "\tres, err := %s\n\tif err != nil {\n\t\treturn\n\t}\n\terr = res.Decode(&[]interface{}{%s})\n\treturn\n}\n", call, strings.Join(refs, ", "))
+	}
+	return nil
+}
+
+// typeString returns typ as written in the generated source, recording the
+// packages to import.
+func (g *generator) typeString(typ reflect.Type) (string, error) {
+	if typ.Name() != "" {
+		path := typ.PkgPath()
+		if path == "" {
+			return typ.Name(), nil
+		}
+		if path == "main" {
+			return "", errors.New("type " + typ.String() + " of package main can't be imported")
+		}
+		name := strings.SplitN(typ.String(), ".", 2)[0]
+		for p, n := range g.imports {
+			if n == name && p != path {
+				return "", fmt.Errorf("packages %s and %s are both named %s", p, path, name)
+			}
+		}
+		g.imports[path] = name
+		return typ.String(), nil
+	}
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		elem, err := g.typeString(typ.Elem())
+		if err != nil {
+			return "", err
+		}
+		if typ.Kind() == reflect.Ptr {
+			return "*" + elem, nil
+		}
+		return "[]" + elem, nil
+	case reflect.Array:
+		elem, err := g.typeString(typ.Elem())
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("[%d]%s", typ.Len(), elem), nil
+	case reflect.Map:
+		key, err := g.typeString(typ.Key())
+		if err != nil {
+			return "", err
+		}
+		elem, err := g.typeString(typ.Elem())
+		if err != nil {
+			return "", err
+		}
+		return "map[" + key + "]" + elem, nil
+	case reflect.Interface:
+		if typ.NumMethod() == 0 {
+			return "interface{}", nil
+		}
+	}
+	return "", errors.New("can't write type " + typ.String())
+}
+
+// identifier returns name as an exported Go identifier, dropping the
+// characters that can't appear in one and capitalizing the words they
+// separate: "get_repo" becomes "GetRepo".
+func identifier(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if b.Len() == 0 && unicode.IsDigit(r) {
+			b.WriteRune('X')
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,379 @@
+package searpc
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+var typeOfUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+var typeOfTextUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+var typeOfTime = reflect.TypeOf(time.Time{})
+var typeOfJSONNumber = reflect.TypeOf(json.Number(""))
+
+// A ConverterFunc converts a value decoded from a call string, such as a
+// string, a float64 or a map[string]interface{}, to a parameter type.
+type ConverterFunc func(arg interface{}) (reflect.Value, error)
+
+// RegisterConverter makes fn convert the arguments passed for parameters of
+// type targetType, for instance to parse a string as a UUID. fn is consulted
+// before the built-in conversion rules, which it replaces for targetType. A
+// nil fn removes the converter.
+func (server *Server) RegisterConverter(targetType reflect.Type, fn ConverterFunc) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	// Calls in progress may hold the current map.
+	converters := make(map[reflect.Type]ConverterFunc, len(server.converters)+1)
+	for t, f := range server.converters {
+		converters[t] = f
+	}
+	if fn == nil {
+		delete(converters, targetType)
+	} else {
+		converters[targetType] = fn
+	}
+	server.converters = converters
+}
+
+// RegisterConcreteType makes arguments for parameters of interface type iface
+// be decoded as values of type concrete, which must implement iface. Only one
+// concrete type can be registered for an interface: the call string carries
+// no type information to choose between several. null is passed as a nil
+// interface.
+func (server *Server) RegisterConcreteType(iface, concrete reflect.Type) error {
+	if iface.Kind() != reflect.Interface {
+		s := "searpc.RegisterConcreteType: " + iface.String() + " is not an interface"
+		server.logf("%s", s)
+		return errors.New(s)
+	}
+	if !concrete.Implements(iface) {
+		s := "searpc.RegisterConcreteType: " + concrete.String() + " does not implement " + iface.String()
+		server.logf("%s", s)
+		return errors.New(s)
+	}
+	server.RegisterConverter(iface, func(arg interface{}) (reflect.Value, error) {
+		if arg == nil {
+			return reflect.Zero(iface), nil
+		}
+		return convertArg(arg, concrete)
+	})
+	return nil
+}
+
+// converter holds the conversion settings of a server.
+type converter struct {
+	funcs        map[reflect.Type]ConverterFunc // set by RegisterConverter
+	lenientBools bool                           // set by SetLenientBools
+	local        bool                           // arguments are Go values passed by CallLocal
+}
+
+// SetLenientBools makes numbers accepted for boolean parameters, as sent by
+// some older clients: zero is false and any other number is true. It must
+// not be called concurrently with calls to the server.
+func (server *Server) SetLenientBools(lenient bool) {
+	server.lenientBools = lenient
+}
+
+// convert converts arg to typ with the converter registered for typ, if
+// any, or else with convertArg. Go values passed by CallLocal are used as is
+// when they are assignable to typ.
+func (cv converter) convert(arg interface{}, typ reflect.Type) (reflect.Value, error) {
+	if a := reflect.ValueOf(arg); cv.local && a.IsValid() {
+		if a.Type().AssignableTo(typ) {
+			return a, nil
+		}
+		if sameKind(typ.Kind(), reflect.Float64) && isNumber(a.Kind()) {
+			// Go integer constants are ints, even where floats are
+			// expected.
+			return a.Convert(typ), nil
+		}
+	}
+	fn := cv.funcs[typ]
+	if fn == nil {
+		if cv.lenientBools && typ.Kind() == reflect.Bool {
+			if b, ok := numberToBool(arg); ok {
+				return reflect.ValueOf(b).Convert(typ), nil
+			}
+		}
+		return convertArg(arg, typ)
+	}
+	v, err := fn(arg)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if !v.IsValid() {
+		return reflect.Value{}, fmt.Errorf("converter for %s returned no value", typ)
+	}
+	if !v.Type().AssignableTo(typ) {
+		return reflect.Value{}, fmt.Errorf("converter for %s returned %s", typ, v.Type())
+	}
+	return v, nil
+}
+
+// numberToBool reports whether arg is a non-zero number, and whether it is a
+// number at all.
+func numberToBool(arg interface{}) (b, ok bool) {
+	switch n := arg.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f != 0, err == nil
+	case float64:
+		return n != 0, true
+	case int64:
+		return n != 0, true
+	case uint64:
+		return n != 0, true
+	}
+	return false, false
+}
+
+// convertArg converts a value decoded from a call string to the declared
+// parameter type typ. JSON numbers are decoded as float64, so they are
+// converted to integer types here, provided they are integral and fit in typ.
+// With JSONEncoding, numbers are decoded as json.Number so that integers are
+// converted exactly. An error is
+// returned if arg doesn't match typ, rather than letting the call panic.
+func convertArg(arg interface{}, typ reflect.Type) (reflect.Value, error) {
+	if arg == nil {
+		// null is only accepted for types that can be nil.
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			return reflect.Zero(typ), nil
+		}
+		return reflect.Value{}, fmt.Errorf("expected %s, got null", typ)
+	}
+	if typ.Kind() == reflect.Ptr && !decodesItself(typ) && !reflect.TypeOf(arg).AssignableTo(typ) {
+		// Convert to the element type and point to the result.
+		elem, err := convertArg(arg, typ.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		p := reflect.New(typ.Elem())
+		p.Elem().Set(elem)
+		return p, nil
+	}
+	if n, ok := arg.(json.Number); ok && typ != typeOfJSONNumber {
+		switch typ.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if i, err := strconv.ParseInt(n.String(), 10, 64); err == nil {
+				return convertInt(i, typ)
+			} else if errors.Is(err, strconv.ErrRange) {
+				return reflect.Value{}, fmt.Errorf("%s overflows %s", n, typ)
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if i, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+				return convertUint(i, typ)
+			} else if errors.Is(err, strconv.ErrRange) {
+				return reflect.Value{}, fmt.Errorf("%s overflows %s", n, typ)
+			}
+		}
+		if !decodesItself(typ) {
+			// Not an integer literal, or not an integer parameter.
+			f, err := n.Float64()
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("%s overflows %s", n, typ)
+			}
+			arg = f
+		}
+	}
+	if reflect.TypeOf(arg).AssignableTo(typ) {
+		// Encodings other than JSON may produce the right type already.
+		return reflect.ValueOf(plainNumbers(arg)), nil
+	}
+	if typ == typeOfTime {
+		str, ok := arg.(string)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("expected RFC 3339 time string, got %T", arg)
+		}
+		t, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("expected RFC 3339 time: %v", err)
+		}
+		return reflect.ValueOf(t), nil
+	}
+	if decodesItself(typ) {
+		// Let the custom decoding of the type run.
+		return remarshal(arg, typ)
+	}
+	if str, ok := arg.(string); ok && typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 {
+		// JSON carries byte slices as base64 strings.
+		b, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("expected base64 string: %v", err)
+		}
+		return reflect.ValueOf(b).Convert(typ), nil
+	}
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return convertInt(arg, typ)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return convertUint(arg, typ)
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+		// JSON arrays and objects are decoded as []interface{} and
+		// map[string]interface{}, decode them again into typ.
+		return remarshal(arg, typ)
+	}
+	v := reflect.ValueOf(arg)
+	if !v.Type().AssignableTo(typ) {
+		// Allow conversions within a kind, such as to a named string type
+		// or from float64 to float32, and from integers to floats, which
+		// MessagePack encoders send for integral values.
+		toFloat := isNumber(v.Kind()) && (typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64)
+		if !(sameKind(v.Kind(), typ.Kind()) || toFloat) || !v.Type().ConvertibleTo(typ) {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %s", typ, v.Type())
+		}
+		v = v.Convert(typ)
+	}
+	return v, nil
+}
+
+// plainNumbers returns a copy of arg with the json.Number values it holds
+// replaced by float64, so that functions taking interface{} parameters get
+// the same values as json.Unmarshal produces by default. Arrays and objects
+// are copied rather than modified, since the decoded arguments are also
+// seen by interceptors and may belong to the caller of CallArgs.
+func plainNumbers(arg interface{}) interface{} {
+	switch v := arg.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i := range v {
+			c[i] = plainNumbers(v[i])
+		}
+		return c
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key := range v {
+			c[key] = plainNumbers(v[key])
+		}
+		return c
+	}
+	return arg
+}
+
+// decodesItself reports whether values of typ implement json.Unmarshaler or
+// encoding.TextUnmarshaler.
+func decodesItself(typ reflect.Type) bool {
+	for _, t := range []reflect.Type{typ, reflect.PtrTo(typ)} {
+		if t.Implements(typeOfUnmarshaler) || t.Implements(typeOfTextUnmarshaler) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodable reports whether arguments of type typ can be produced from a
+// call: channels, functions, complex numbers and unsafe pointers can't.
+func decodable(typ reflect.Type) bool {
+	for {
+		if decodesItself(typ) {
+			return true
+		}
+		switch typ.Kind() {
+		case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+			return false
+		case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+			typ = typ.Elem()
+		default:
+			return true
+		}
+	}
+}
+
+// remarshal encodes arg back to JSON and decodes it into a new value of
+// type typ.
+func remarshal(arg interface{}, typ reflect.Type) (reflect.Value, error) {
+	data, err := json.Marshal(arg)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	v := reflect.New(typ)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("expected %s: %v", typ, err)
+	}
+	return v.Elem(), nil
+}
+
+func sameKind(a, b reflect.Kind) bool {
+	if a == reflect.Float32 || a == reflect.Float64 {
+		return b == reflect.Float32 || b == reflect.Float64
+	}
+	return a == b
+}
+
+// isNumber reports whether k is the kind of an integer or float type.
+func isNumber(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+// convertInt converts a number to the signed integer type typ.
+func convertInt(arg interface{}, typ reflect.Type) (reflect.Value, error) {
+	v := reflect.New(typ).Elem()
+	av := reflect.ValueOf(arg)
+	switch av.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f := av.Float()
+		if f != math.Trunc(f) {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %v", typ, f)
+		}
+		if f < math.MinInt64 || f >= math.MaxInt64 || v.OverflowInt(int64(f)) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", f, typ)
+		}
+		v.SetInt(int64(f))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := av.Int()
+		if v.OverflowInt(n) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", n, typ)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := av.Uint()
+		if n > math.MaxInt64 || v.OverflowInt(int64(n)) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", n, typ)
+		}
+		v.SetInt(int64(n))
+	default:
+		return reflect.Value{}, fmt.Errorf("expected %s, got %s", typ, av.Type())
+	}
+	return v, nil
+}
+
+// convertUint converts a number to the unsigned integer type typ.
+func convertUint(arg interface{}, typ reflect.Type) (reflect.Value, error) {
+	v := reflect.New(typ).Elem()
+	av := reflect.ValueOf(arg)
+	switch av.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f := av.Float()
+		if f != math.Trunc(f) {
+			return reflect.Value{}, fmt.Errorf("expected %s, got %v", typ, f)
+		}
+		if f < 0 || f >= math.MaxUint64 || v.OverflowUint(uint64(f)) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", f, typ)
+		}
+		v.SetUint(uint64(f))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := av.Int()
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", n, typ)
+		}
+		v.SetUint(uint64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := av.Uint()
+		if v.OverflowUint(n) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", n, typ)
+		}
+		v.SetUint(n)
+	default:
+		return reflect.Value{}, fmt.Errorf("expected %s, got %s", typ, av.Type())
+	}
+	return v, nil
+}
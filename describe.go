@@ -0,0 +1,81 @@
+package searpc
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// ServiceDescription describes a registered service in the document returned
+// by Describe.
+type ServiceDescription struct {
+	Name      string                `json:"name"`
+	Functions []FunctionDescription `json:"functions"`
+	// Aliases maps the names added by AliasFunc to the functions they
+	// may run.
+	Aliases map[string][]string `json:"aliases,omitempty"`
+}
+
+// FunctionDescription describes a function of a service. Types are given as
+// Go type names.
+type FunctionDescription struct {
+	Name     string   `json:"name"`
+	Params   []string `json:"params"`             // parameter types, without the context
+	Variadic bool     `json:"variadic,omitempty"` // the last parameter takes any number of arguments
+	Optional int      `json:"optional,omitempty"` // number of trailing arguments that may be omitted
+	// Returns lists the types of the values returned in Ret, as an array
+	// if there are several. It is empty for functions returning a Result or
+	// a *Result, whose Ret can hold anything.
+	Returns []string `json:"returns"`
+}
+
+// Describe returns a JSON document describing the registered services and
+// their functions, sorted by name, for instance to generate clients.
+func (server *Server) Describe() ([]byte, error) {
+	server.lock.RLock()
+	descs := make([]ServiceDescription, 0, len(server.serviceMap))
+	for name, s := range server.serviceMap {
+		desc := ServiceDescription{Name: name, Functions: make([]FunctionDescription, 0, len(s.method))}
+		for mname, mt := range s.method {
+			desc.Functions = append(desc.Functions, mt.describe(mname))
+		}
+		sort.Slice(desc.Functions, func(i, j int) bool {
+			return desc.Functions[i].Name < desc.Functions[j].Name
+		})
+		for ename, mts := range s.overloads {
+			if desc.Aliases == nil {
+				desc.Aliases = make(map[string][]string)
+			}
+			for _, mt := range mts {
+				desc.Aliases[ename] = append(desc.Aliases[ename], mt.name)
+			}
+		}
+		descs = append(descs, desc)
+	}
+	server.lock.RUnlock()
+	sort.Slice(descs, func(i, j int) bool { return descs[i].Name < descs[j].Name })
+	return json.Marshal(struct {
+		Services []ServiceDescription `json:"services"`
+	}{descs})
+}
+
+// describe returns the description of the method, named name.
+func (mtype *methodType) describe(name string) FunctionDescription {
+	desc := FunctionDescription{
+		Name:     name,
+		Params:   make([]string, 0, len(mtype.argTypes)),
+		Variadic: mtype.variadic,
+		Optional: mtype.optional,
+		Returns:  []string{},
+	}
+	for _, typ := range mtype.argTypes {
+		desc.Params = append(desc.Params, typ.String())
+	}
+	if ftype := mtype.method.Type; mtype.retErr && !(ftype.NumOut() == 2 && (ftype.Out(0) == typeOfResult || ftype.Out(0) == typeOfResultValue)) {
+		for i := 0; i < ftype.NumOut()-1; i++ {
+			desc.Returns = append(desc.Returns, ftype.Out(i).String())
+		}
+	} else if mtype.stream {
+		desc.Returns = append(desc.Returns, typeOfStream.String())
+	}
+	return desc
+}
@@ -0,0 +1,218 @@
+package searpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Encoding is the format of call strings and results.
+type Encoding interface {
+	// Marshal encodes v, which is a Result for results.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v.
+	Unmarshal(data []byte, v interface{}) error
+	// UnmarshalCall decodes a call string. A well formed call string
+	// decodes to a []interface{} holding the function name followed by
+	// the arguments.
+	UnmarshalCall(data []byte) (interface{}, error)
+}
+
+// JSONEncoding is the searpc JSON format, the default encoding.
+type JSONEncoding struct{}
+
+func (JSONEncoding) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONEncoding) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// UnmarshalCall decodes numbers as json.Number, so that large integer
+// arguments don't lose precision.
+func (JSONEncoding) UnmarshalCall(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var call interface{}
+	if err := dec.Decode(&call); err != nil {
+		return nil, err
+	}
+	// Only whitespace may follow the call array.
+	for i := dec.InputOffset(); i < int64(len(data)); i++ {
+		switch c := data[i]; c {
+		case ' ', '\t', '\n', '\r':
+		default:
+			return nil, &trailingDataError{char: c, Offset: i + 1}
+		}
+	}
+	return call, nil
+}
+
+// trailingDataError reports data after the value of a call string. Like
+// json.SyntaxError, Offset is the number of bytes read when the error
+// occurred.
+type trailingDataError struct {
+	char   byte
+	Offset int64
+}
+
+func (e *trailingDataError) Error() string {
+	return fmt.Sprintf("invalid character %q after top-level value", e.char)
+}
+
+// RawJSON is a value that is already JSON encoded, such as a document
+// stored by the service, for functions to return in Ret. JSONEncoding embeds
+// it as is rather than as a string. Results holding invalid JSON fail with
+// InternalServerError.
+type RawJSON string
+
+// MarshalJSON returns r, or an error if it isn't valid JSON.
+func (r RawJSON) MarshalJSON() ([]byte, error) {
+	if !json.Valid([]byte(r)) {
+		return nil, errors.New("searpc: invalid raw JSON")
+	}
+	return []byte(r), nil
+}
+
+// GobEncoding encodes calls and results with encoding/gob, for transports
+// between Go programs. Unlike JSON, it preserves the types of arguments, so
+// that 64-bit integers don't lose precision. Call strings are gob encoded
+// []interface{}; types other than the basic ones used in arguments or in
+// Result.Ret must be registered with gob.Register.
+type GobEncoding struct{}
+
+func (GobEncoding) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobEncoding) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (GobEncoding) UnmarshalCall(data []byte) (interface{}, error) {
+	var call []interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&call); err != nil {
+		return nil, err
+	}
+	return call, nil
+}
+
+// SetEncoding sets the encoding of call strings and results. The default is
+// JSONEncoding. It must not be called concurrently with calls to the server.
+func (server *Server) SetEncoding(enc Encoding) {
+	server.enc = enc
+}
+
+// SetIndent makes results encoded with JSONEncoding pretty-printed, each
+// element beginning on a new line starting with prefix followed by copies of
+// indent, as json.MarshalIndent does. Such output is stable, which suits
+// golden-file tests, but can't be used with the newline-delimited CallStream
+// and CallStreaming. Empty strings restore the compact default. It must not
+// be called concurrently with calls to the server.
+func (server *Server) SetIndent(prefix, indent string) {
+	server.prefix, server.indent = prefix, indent
+}
+
+// SetResultFieldNames sets the JSON keys of the returned value, the error
+// code and the error message in results encoded with JSONEncoding, for
+// clients expecting names such as error_code and error_message rather than
+// the default ret, err_code and err_msg. An empty string keeps the default
+// name. Client and DecodeResult only understand the default names. It must
+// not be called concurrently with calls to the server.
+func (server *Server) SetResultFieldNames(ret, code, msg string) {
+	fields := &resultFields{ret: "ret", code: "err_code", msg: "err_msg"}
+	if ret != "" {
+		fields.ret = ret
+	}
+	if code != "" {
+		fields.code = code
+	}
+	if msg != "" {
+		fields.msg = msg
+	}
+	if *fields == (resultFields{ret: "ret", code: "err_code", msg: "err_msg"}) {
+		fields = nil
+	}
+	server.fields = fields
+}
+
+// resultFields holds the JSON keys set by SetResultFieldNames.
+type resultFields struct {
+	ret, code, msg string
+}
+
+// marshal encodes res with enc, using the keys set by SetResultFieldNames
+// if enc is JSON.
+func (server *Server) marshal(enc Encoding, res Result) ([]byte, error) {
+	if server.fields != nil {
+		switch enc.(type) {
+		case JSONEncoding, indentedJSON:
+			return enc.Marshal(renamedResult{res, server.fields})
+		}
+	}
+	return enc.Marshal(res)
+}
+
+// renamedResult encodes a Result like its struct tags do, under other keys.
+type renamedResult struct {
+	res    Result
+	fields *resultFields
+}
+
+func (r renamedResult) MarshalJSON() ([]byte, error) {
+	members := []struct {
+		key   string
+		value interface{}
+		omit  bool
+	}{
+		{r.fields.ret, r.res.Ret, false},
+		{r.fields.code, r.res.ErrCode, r.res.ErrCode == 0},
+		{r.fields.msg, r.res.ErrMsg, r.res.ErrMsg == ""},
+		{"req_id", r.res.ReqID, r.res.ReqID == ""},
+		{"extra", r.res.Extra, len(r.res.Extra) == 0},
+	}
+	buf := []byte{'{'}
+	for _, m := range members {
+		if m.omit {
+			continue
+		}
+		key, _ := json.Marshal(m.key)
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = append(append(append(buf, key...), ':'), value...)
+	}
+	return append(buf, '}'), nil
+}
+
+// indentedJSON is JSONEncoding with indented results.
+type indentedJSON struct {
+	JSONEncoding
+	prefix, indent string
+}
+
+func (e indentedJSON) Marshal(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, e.prefix, e.indent)
+}
+
+func (server *Server) encoding() Encoding {
+	enc := server.enc
+	if enc == nil {
+		enc = JSONEncoding{}
+	}
+	if _, ok := enc.(JSONEncoding); ok && (server.prefix != "" || server.indent != "") {
+		return indentedJSON{prefix: server.prefix, indent: server.indent}
+	}
+	return enc
+}
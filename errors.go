@@ -0,0 +1,100 @@
+package searpc
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is an error code reported in the err_code field of a result.
+// Result.ErrCode is a plain int, use Result.Code to get it as an ErrorCode.
+type ErrorCode int
+
+// Error codes reported by the server itself. Functions may use other codes.
+const (
+	ServiceNotFoundError  ErrorCode = 501 // no service with the requested name
+	FunctionNotFoundError ErrorCode = 500 // no function with the requested name
+	ParseJSONError        ErrorCode = 511 // the call string can't be decoded
+	ParameterError        ErrorCode = 512 // the arguments don't match the function
+	InternalServerError   ErrorCode = 513 // the function panicked
+	FunctionError         ErrorCode = 514 // the function returned an error
+	TimeoutError          ErrorCode = 515 // the function didn't return in time
+	MethodDisabledError   ErrorCode = 516 // the function is turned off
+	BusyError             ErrorCode = 517 // too many calls in progress
+	MalformedCallError    ErrorCode = 518 // the call string isn't a call array
+	ShuttingDownError     ErrorCode = 519 // the server no longer accepts calls
+	RequestTooLargeError  ErrorCode = 520 // the call string exceeds SetMaxCallSize
+	UnauthorizedError     ErrorCode = 521 // rejected by AuthInterceptor
+	RateLimitedError      ErrorCode = 522 // rejected by RateLimitInterceptor
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ServiceNotFoundError:  "service not found",
+	FunctionNotFoundError: "function not found",
+	ParseJSONError:        "parse JSON error",
+	ParameterError:        "parameter error",
+	InternalServerError:   "internal server error",
+	FunctionError:         "function error",
+	TimeoutError:          "timeout",
+	MethodDisabledError:   "method disabled",
+	BusyError:             "busy",
+	MalformedCallError:    "malformed call",
+	ShuttingDownError:     "shutting down",
+	RequestTooLargeError:  "request too large",
+	UnauthorizedError:     "unauthorized",
+	RateLimitedError:      "rate limited",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+var httpStatuses = map[ErrorCode]int{
+	ServiceNotFoundError:  http.StatusNotFound,
+	FunctionNotFoundError: http.StatusNotFound,
+	ParseJSONError:        http.StatusBadRequest,
+	ParameterError:        http.StatusBadRequest,
+	InternalServerError:   http.StatusInternalServerError,
+	FunctionError:         http.StatusInternalServerError,
+	TimeoutError:          http.StatusGatewayTimeout,
+	MethodDisabledError:   http.StatusForbidden,
+	BusyError:             http.StatusServiceUnavailable,
+	MalformedCallError:    http.StatusBadRequest,
+	ShuttingDownError:     http.StatusServiceUnavailable,
+	RequestTooLargeError:  http.StatusRequestEntityTooLarge,
+	UnauthorizedError:     http.StatusUnauthorized,
+	RateLimitedError:      http.StatusTooManyRequests,
+}
+
+// HTTPStatus returns the HTTP status code matching the error code of the
+// result, for HTTP adapters: 200 for a successful result, and 500 for codes
+// chosen by functions.
+func (r Result) HTTPStatus() int {
+	if r.ErrCode == 0 {
+		return http.StatusOK
+	}
+	if status, ok := httpStatuses[r.Code()]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// RPCError is an error carrying the code and message of an error Result.
+// Functions returning (T, error) can return an *RPCError to choose the
+// err_code reported to the client.
+type RPCError struct {
+	ErrCode int
+	ErrMsg  string
+}
+
+// NewRPCError returns an *RPCError with code and a message formatted
+// according to format.
+func NewRPCError(code int, format string, args ...interface{}) *RPCError {
+	return &RPCError{ErrCode: code, ErrMsg: fmt.Sprintf(format, args...)}
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("searpc: error %d: %s", e.ErrCode, e.ErrMsg)
+}
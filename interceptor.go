@@ -0,0 +1,224 @@
+package searpc
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CallInfo describes a call being handled by the server.
+type CallInfo struct {
+	Service string // name of the service
+	Method  string // name of the function, as found in the call string
+	CallStr []byte // the raw call string
+
+	// Args holds the arguments as decoded from the call string, before
+	// their conversion to the parameter types. The function receives its
+	// own converted copies, nested arrays and objects included, so Args
+	// may be inspected, but an interceptor redacting sensitive values
+	// before logging them should modify a copy of the slice: it is shared
+	// with the other interceptors.
+	Args []interface{}
+}
+
+// Interceptor wraps the invocation of functions. It is called with the
+// description of the call and invoke, which runs the function (and the
+// interceptors registered after this one) and returns its result. An
+// interceptor may return a Result of its own without calling invoke to
+// reject a call. invoke must not be called once the interceptor has
+// returned.
+type Interceptor func(info CallInfo, invoke func() Result) Result
+
+// Use adds an interceptor around function invocations. Interceptors are
+// applied in the order they are added, the first one being the outermost.
+func (server *Server) Use(i Interceptor) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	// Calls in progress may hold the current slice.
+	server.interceptors = append(server.interceptors[:len(server.interceptors):len(server.interceptors)], i)
+}
+
+// intercept runs invoke through interceptors.
+func intercept(interceptors []Interceptor, info CallInfo, invoke func() Result) Result {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoke
+		invoke = func() Result {
+			return interceptor(info, next)
+		}
+	}
+	return invoke()
+}
+
+// MethodStats holds call statistics of a function, as recorded by the
+// interceptor returned by MetricsInterceptor.
+type MethodStats struct {
+	Count    int64         // number of calls
+	Errors   int64         // number of calls whose result has an error code
+	Duration time.Duration // total time spent in calls
+}
+
+// MetricsInterceptor returns an interceptor recording call statistics for
+// every function, available from Stats. Install it with
+//
+//	server.Use(server.MetricsInterceptor())
+func (server *Server) MetricsInterceptor() Interceptor {
+	return func(info CallInfo, invoke func() Result) Result {
+		start := time.Now()
+		res := invoke()
+		d := time.Since(start)
+
+		server.statsLock.Lock()
+		defer server.statsLock.Unlock()
+		if server.stats == nil {
+			server.stats = make(map[string]*MethodStats)
+		}
+		key := info.Service + "." + info.Method
+		st := server.stats[key]
+		if st == nil {
+			st = new(MethodStats)
+			server.stats[key] = st
+		}
+		st.Count++
+		if res.ErrCode != 0 {
+			st.Errors++
+		}
+		st.Duration += d
+		return res
+	}
+}
+
+// Stats returns the statistics recorded by MetricsInterceptor, keyed by
+// "Service.function".
+func (server *Server) Stats() map[string]MethodStats {
+	server.statsLock.Lock()
+	defer server.statsLock.Unlock()
+	stats := make(map[string]MethodStats, len(server.stats))
+	for key, st := range server.stats {
+		stats[key] = *st
+	}
+	return stats
+}
+
+// AuthInterceptor returns an interceptor rejecting calls for which authFn
+// returns an error with an UnauthorizedError result. Calls to the functions
+// named in exempt, such as a health check, are let through without calling
+// authFn. Names are matched regardless of case, in every service.
+func AuthInterceptor(authFn func(info CallInfo) error, exempt ...string) Interceptor {
+	skip := make(map[string]bool, len(exempt))
+	for _, name := range exempt {
+		skip[strings.ToLower(name)] = true
+	}
+	return func(info CallInfo, invoke func() Result) Result {
+		if !skip[strings.ToLower(info.Method)] {
+			if err := authFn(info); err != nil {
+				return Result{ErrCode: int(UnauthorizedError), ErrMsg: err.Error()}
+			}
+		}
+		return invoke()
+	}
+}
+
+// RateLimitInterceptor returns an interceptor rejecting calls with a
+// RateLimitedError result when they exceed the rate set for their function
+// in limits, in calls per second, keyed by "Service.function" like Stats.
+// Function names are matched regardless of case. Calls are allowed in
+// bursts of up to a second's worth, and at least one. Functions without a
+// limit are not limited.
+func RateLimitInterceptor(limits map[string]float64) Interceptor {
+	rates := make(map[string]float64, len(limits))
+	for key, limit := range limits {
+		if i := strings.LastIndexByte(key, '.'); i >= 0 {
+			key = key[:i] + strings.ToLower(key[i:])
+		}
+		rates[key] = limit
+	}
+	var lock sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	return func(info CallInfo, invoke func() Result) Result {
+		key := info.Service + "." + strings.ToLower(info.Method)
+		limit, ok := rates[key]
+		if !ok {
+			return invoke()
+		}
+		lock.Lock()
+		b := buckets[key]
+		if b == nil {
+			b = newTokenBucket(limit)
+			buckets[key] = b
+		}
+		allowed := b.take(time.Now())
+		lock.Unlock()
+		if !allowed {
+			return Result{ErrCode: int(RateLimitedError), ErrMsg: "Rate limit exceeded for " + key}
+		}
+		return invoke()
+	}
+}
+
+// tokenBucket allows rate calls per second, in bursts of up to burst calls.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take reports whether a call is allowed at now, using up a token if so.
+func (b *tokenBucket) take(now time.Time) bool {
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens += d.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// methodHealth holds the counters of a function reported by MethodHealth.
+type methodHealth struct {
+	calls   int64        // accessed atomically
+	errors  int64        // accessed atomically
+	lastErr atomic.Value // string
+}
+
+func (h *methodHealth) record(res Result) {
+	atomic.AddInt64(&h.calls, 1)
+	if res.ErrCode != 0 {
+		atomic.AddInt64(&h.errors, 1)
+		h.lastErr.Store(res.ErrMsg)
+	}
+}
+
+// MethodHealth returns the number of calls of function methodName of the
+// named service, the number of them whose result has an error code, and the
+// error message of the last of those. Unlike MetricsInterceptor, these
+// counters are always maintained, cheaply enough for a health endpoint.
+// Calls rejected before reaching the function, for instance because of
+// mismatching parameters, are not counted.
+func (server *Server) MethodHealth(serviceName, methodName string) (calls int64, errors int64, lastErr string) {
+	server.lock.RLock()
+	var mt *methodType
+	if service := server.serviceMap[serviceName]; service != nil {
+		mt = service.method[strings.ToLower(methodName)]
+	}
+	server.lock.RUnlock()
+	if mt == nil {
+		return 0, 0, ""
+	}
+	lastErr, _ = mt.health.lastErr.Load().(string)
+	return atomic.LoadInt64(&mt.health.calls), atomic.LoadInt64(&mt.health.errors), lastErr
+}
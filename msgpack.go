@@ -0,0 +1,485 @@
+package searpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// MsgpackEncoding encodes calls and results in MessagePack, for compact
+// binary transports with clients in other languages. The call string is the
+// same [funcName, arg1, arg2, ...] array as in JSON, and results are maps
+// with the same keys as their JSON encoding. A []byte is encoded as binary.
+//
+// Integers keep their precision and are decoded as int64, or uint64 if they
+// don't fit. Binary strings are decoded as []byte. Structs and other types
+// implementing json.Marshaler are encoded as their JSON form would be.
+// Extension types are not supported.
+type MsgpackEncoding struct{}
+
+func (MsgpackEncoding) Marshal(v interface{}) ([]byte, error) {
+	var e msgpackEncoder
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (MsgpackEncoding) Unmarshal(data []byte, v interface{}) error {
+	g, err := decodeMsgpack(data)
+	if err != nil {
+		return err
+	}
+	if res, ok := v.(*Result); ok {
+		// Decode Ret without going through JSON, which would turn
+		// integers into float64.
+		m, ok := g.(map[string]interface{})
+		if !ok {
+			return errors.New("msgpack: result is not a map")
+		}
+		*res = Result{Ret: m["ret"]}
+		if code, ok := m["err_code"].(int64); ok {
+			res.ErrCode = int(code)
+		}
+		res.ErrMsg, _ = m["err_msg"].(string)
+		res.ReqID, _ = m["req_id"].(string)
+		res.Extra, _ = m["extra"].(map[string]interface{})
+		return nil
+	}
+	data, err = json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (MsgpackEncoding) UnmarshalCall(data []byte) (interface{}, error) {
+	return decodeMsgpack(data)
+}
+
+var typeOfMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) write(b ...byte) {
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) writeUint(code byte, n uint64, size int) {
+	e.write(code)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	e.write(b[8-size:]...)
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.write(0xc0)
+		return nil
+	}
+	if v.Type() == typeOfJSONNumber {
+		if n, err := v.Interface().(json.Number).Int64(); err == nil {
+			e.encodeInt(n)
+			return nil
+		}
+		f, err := v.Interface().(json.Number).Float64()
+		if err != nil {
+			return err
+		}
+		e.writeUint(0xcb, math.Float64bits(f), 8)
+		return nil
+	}
+	if v.Type() == typeOfResult.Elem() {
+		return e.encodeResult(v.Interface().(Result))
+	}
+	if v.Kind() == reflect.Struct || v.Type().Implements(typeOfMarshaler) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			e.write(0xc0)
+			return nil
+		}
+		return e.encodeJSON(v)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.write(0xc3)
+		} else {
+			e.write(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.writeUint(0xca, uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.writeUint(0xcb, math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		e.encodeLen(len(v.String()), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		e.buf = append(e.buf, v.String()...)
+	case reflect.Slice:
+		if v.IsNil() {
+			e.write(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeLen(v.Len(), 0, 0, 0xc4, 0xc5, 0xc6)
+			e.write(v.Bytes()...)
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.write(0xc0)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.write(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.encodeUint(uint64(n))
+	case n >= -32:
+		e.write(byte(n))
+	case n >= math.MinInt8:
+		e.writeUint(0xd0, uint64(n), 1)
+	case n >= math.MinInt16:
+		e.writeUint(0xd1, uint64(n), 2)
+	case n >= math.MinInt32:
+		e.writeUint(0xd2, uint64(n), 4)
+	default:
+		e.writeUint(0xd3, uint64(n), 8)
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.write(byte(n))
+	case n <= math.MaxUint8:
+		e.writeUint(0xcc, n, 1)
+	case n <= math.MaxUint16:
+		e.writeUint(0xcd, n, 2)
+	case n <= math.MaxUint32:
+		e.writeUint(0xce, n, 4)
+	default:
+		e.writeUint(0xcf, n, 8)
+	}
+}
+
+// encodeLen writes the header of a string, binary, array or map of length
+// n. fix is the code of the fixed size format, used if n < fixMax, then
+// come the codes of the formats with 8, 16 and 32 bit lengths. A zero code
+// means the format doesn't exist.
+func (e *msgpackEncoder) encodeLen(n int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case n < fixMax:
+		e.write(fix | byte(n))
+	case n <= math.MaxUint8 && code8 != 0:
+		e.writeUint(code8, uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.writeUint(code16, uint64(n), 2)
+	default:
+		e.writeUint(code32, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	e.encodeLen(v.Len(), 0x90, 16, 0, 0xdc, 0xdd)
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeMap(v reflect.Value) error {
+	e.encodeLen(v.Len(), 0x80, 16, 0, 0xde, 0xdf)
+	keys := v.MapKeys()
+	if v.Type().Key().Kind() == reflect.String {
+		// Sort keys so that the output is stable.
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+	}
+	for _, key := range keys {
+		if err := e.encode(key); err != nil {
+			return err
+		}
+		if err := e.encode(v.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeResult encodes res as a map with the keys of its JSON encoding. Ret
+// is encoded directly so that, for instance, a []byte is sent as binary.
+func (e *msgpackEncoder) encodeResult(res Result) error {
+	n := 1
+	if res.ErrCode != 0 {
+		n++
+	}
+	if res.ErrMsg != "" {
+		n++
+	}
+	if res.ReqID != "" {
+		n++
+	}
+	if len(res.Extra) != 0 {
+		n++
+	}
+	e.encodeLen(n, 0x80, 16, 0, 0xde, 0xdf)
+	e.encode(reflect.ValueOf("ret"))
+	if err := e.encode(reflect.ValueOf(res.Ret)); err != nil {
+		return err
+	}
+	if res.ErrCode != 0 {
+		e.encode(reflect.ValueOf("err_code"))
+		e.encodeInt(int64(res.ErrCode))
+	}
+	if res.ErrMsg != "" {
+		e.encode(reflect.ValueOf("err_msg"))
+		e.encode(reflect.ValueOf(res.ErrMsg))
+	}
+	if res.ReqID != "" {
+		e.encode(reflect.ValueOf("req_id"))
+		e.encode(reflect.ValueOf(res.ReqID))
+	}
+	if len(res.Extra) != 0 {
+		e.encode(reflect.ValueOf("extra"))
+		if err := e.encode(reflect.ValueOf(res.Extra)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeJSON encodes v as its JSON encoding decodes, keeping numbers exact.
+func (e *msgpackEncoder) encodeJSON(v reflect.Value) error {
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var g interface{}
+	if err := dec.Decode(&g); err != nil {
+		return err
+	}
+	return e.encode(reflect.ValueOf(g))
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+// decodeMsgpack decodes a single value from data, which must not have any
+// trailing bytes.
+func decodeMsgpack(data []byte) (interface{}, error) {
+	d := &msgpackDecoder{data: data}
+	v, err := d.decode()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("msgpack: trailing data")
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return d.decodeMap(int(code & 0x0f))
+	case code&0xf0 == 0x90:
+		return d.decodeArray(int(code & 0x0f))
+	case code&0xe0 == 0xa0:
+		return d.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (code - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type code 0x%02x", code)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	// Each element takes at least one byte.
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	array := make([]interface{}, n)
+	for i := range array {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		array[i] = v
+	}
+	return array, nil
+}
+
+// decodeMap decodes a map of n entries, as a map[string]interface{} if all
+// keys are strings or as a map[interface{}]interface{} otherwise.
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	// Each entry takes at least two bytes.
+	if n > (len(d.data)-d.pos)/2 {
+		return nil, errMsgpackShort
+	}
+	keys := make([]interface{}, n)
+	values := make([]interface{}, n)
+	strKeys := true
+	for i := 0; i < n; i++ {
+		key, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := key.(string); !ok {
+			strKeys = false
+		}
+		if key != nil && !reflect.TypeOf(key).Comparable() {
+			return nil, errors.New("msgpack: unsupported map key type")
+		}
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		keys[i], values[i] = key, value
+	}
+	if strKeys {
+		m := make(map[string]interface{}, n)
+		for i, key := range keys {
+			m[key.(string)] = values[i]
+		}
+		return m, nil
+	}
+	m := make(map[interface{}]interface{}, n)
+	for i, key := range keys {
+		m[key] = values[i]
+	}
+	return m, nil
+}
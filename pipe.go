@@ -0,0 +1,72 @@
+package searpc
+
+import (
+	"errors"
+	"sync"
+)
+
+// PipeTransport is a Transport to a Server in the same process, going
+// through the same encoding and decoding steps as a network transport would.
+// It's mostly useful for testing clients and services together:
+//
+//	t := searpc.NewPipeTransport(server)
+//	defer t.Close()
+//	client := searpc.NewClient(t)
+//	res, err := client.Call("MyService", "Function1", 1, "a")
+type PipeTransport struct {
+	requests  chan pipeRequest
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type pipeRequest struct {
+	serviceName string
+	callStr     []byte
+	reply       chan []byte
+}
+
+// NewPipeTransport returns a transport to server. Close must be called to
+// release it.
+func NewPipeTransport(server *Server) *PipeTransport {
+	t := &PipeTransport{
+		requests: make(chan pipeRequest),
+		done:     make(chan struct{}),
+	}
+	go t.serve(server)
+	return t
+}
+
+func (t *PipeTransport) serve(server *Server) {
+	for {
+		select {
+		case req := <-t.requests:
+			go func() {
+				req.reply <- server.Call(req.serviceName, req.callStr)
+			}()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+var errPipeClosed = errors.New("searpc: pipe transport closed")
+
+// Send passes callStr to the server and waits for the result.
+func (t *PipeTransport) Send(serviceName string, callStr []byte) ([]byte, error) {
+	req := pipeRequest{serviceName: serviceName, callStr: callStr, reply: make(chan []byte, 1)}
+	select {
+	case t.requests <- req:
+	case <-t.done:
+		return nil, errPipeClosed
+	}
+	return <-req.reply, nil
+}
+
+// Close stops the transport. Calls in progress complete, later calls to Send
+// fail.
+func (t *PipeTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
@@ -0,0 +1,70 @@
+package searpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// Record is a call recorded by the recorder set with SetRecorder. Call
+// strings and results are kept as bytes, so that any encoding can be
+// recorded. ID is the request ID of calls made through CallWithID.
+type Record struct {
+	Service string `json:"service"`
+	Call    []byte `json:"call"`
+	ID      string `json:"id,omitempty"`
+	Result  []byte `json:"result"`
+}
+
+// SetRecorder makes the server write a Record for each call made through
+// Call, CallContext or CallWithID to w, as a line of JSON. A nil w stops
+// recording. Records written concurrently are not interleaved. It must not be
+// called concurrently with calls to the server.
+func (server *Server) SetRecorder(w io.Writer) {
+	server.recorder = w
+}
+
+// record writes a Record of a call to the recorder, if any.
+func (server *Server) record(serviceName string, callStr []byte, id string, retStr []byte) {
+	if server.recorder == nil {
+		return
+	}
+	data, err := json.Marshal(Record{Service: serviceName, Call: callStr, ID: id, Result: retStr})
+	if err != nil {
+		server.logf("Failed to record call: %v", err)
+		return
+	}
+	server.recLock.Lock()
+	defer server.recLock.Unlock()
+	if _, err := server.recorder.Write(append(data, '\n')); err != nil {
+		server.logf("Failed to record call: %v", err)
+	}
+}
+
+// ReplayDiff is a recorded call whose result differs when it is replayed.
+type ReplayDiff struct {
+	Index  int    // index of the record, starting at 0
+	Record Record // the record
+	Result []byte // the result of the replayed call
+}
+
+// ReplayFile makes again the calls recorded in r, as written by the recorder
+// set with SetRecorder, and returns those whose results differ from the
+// recorded ones. Records with an ID are replayed as by CallWithID. Replayed
+// calls are not recorded, even if server has a recorder. An error is
+// returned if r can't be read or decoded.
+func ReplayFile(server *Server, r io.Reader) ([]ReplayDiff, error) {
+	var diffs []ReplayDiff
+	dec := json.NewDecoder(r)
+	for i := 0; ; i++ {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return diffs, nil
+		} else if err != nil {
+			return diffs, err
+		}
+		if res := server.callWithID(rec.Service, rec.Call, rec.ID); !bytes.Equal(res, rec.Result) {
+			diffs = append(diffs, ReplayDiff{Index: i, Record: rec, Result: res})
+		}
+	}
+}
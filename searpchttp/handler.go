@@ -0,0 +1,57 @@
+// Package searpchttp serves a searpc.Server over HTTP. Each request carries a
+// call string in its body and gets the result in the response body.
+package searpchttp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	searpc "github.com/killing/searpc-go"
+)
+
+type handler struct {
+	server      *searpc.Server
+	serviceName string // service to call, or "" to take it from the path
+	prefix      string // stripped from the path before taking the service name
+}
+
+// NewHTTPHandler returns a handler calling the named service of server with
+// the bodies of POST requests.
+func NewHTTPHandler(server *searpc.Server, serviceName string) http.Handler {
+	return &handler{server: server, serviceName: serviceName}
+}
+
+// NewHTTPPathHandler is like NewHTTPHandler but takes the name of the service
+// from the first segment of the request path after prefix, so that a handler
+// registered for "/rpc/" with prefix "/rpc/" serves "/rpc/MyService".
+func NewHTTPPathHandler(server *searpc.Server, prefix string) http.Handler {
+	return &handler{server: server, prefix: prefix}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serviceName := h.serviceName
+	if serviceName == "" {
+		path := strings.TrimPrefix(r.URL.Path, h.prefix)
+		serviceName = strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+		if serviceName == "" {
+			http.Error(w, "no service name in path", http.StatusNotFound)
+			return
+		}
+	}
+
+	callStr, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	retStr := h.server.CallContext(r.Context(), serviceName, callStr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(retStr)
+}
@@ -20,7 +20,17 @@ func (s *MyService) Function2(a string, b string, c int) *searpc.Result {
 
 svr := searpc.NewServer()
 s := new(MyService)
-svr.Register(s)
+svr.Register(s, "")
+
+or, to choose the service name explicitly:
+
+svr.RegisterName("MyService", s)
+
+Each registration keeps its own receiver, so several instances of a type can
+serve different data under different names:
+
+svr.RegisterName("repo-mgr-tenant1", &RepoManager{tenant: "tenant1"})
+svr.RegisterName("repo-mgr-tenant2", &RepoManager{tenant: "tenant2"})
 
 3. Calling a Service Function
 
@@ -30,41 +40,223 @@ resStr := svr.Call("MyService", jsonStr)
 package searpc
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"reflect"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
 // service is a set of functions.
 type service struct {
-	name   string                     // name of service
-	rcvr   reflect.Value              // receiver of methods for the service
-	typ    reflect.Type               // type of the receiver
-	method map[string]*reflect.Method // registered methods
+	name   string                 // name of service
+	rcvr   reflect.Value          // receiver of methods for the service
+	typ    reflect.Type           // type of the receiver
+	method map[string]*methodType // registered methods
+
+	overloads map[string][]*methodType // set by AliasFunc, chosen by arity
+
+	disabled map[string]bool // functions turned off by DisableMethod
+
+	slots    chan struct{} // one per call in progress, if concurrency is limited
+	failBusy bool          // fail with BusyError rather than wait for a slot
+
+	fallback func(funcName string, args []interface{}) Result // set by SetFallback
+}
+
+// methodType is a registered method, along with what is needed to build its
+// arguments from a call string.
+type methodType struct {
+	health methodHealth // first, for the alignment of its 64-bit counters
+
+	name     string // lowercase name the function is registered under
+	method   reflect.Method
+	hasCtx   bool           // the first parameter is a context.Context
+	argTypes []reflect.Type // types of the parameters taken from the call string
+	retErr   bool           // the method returns values and an error instead of *Result
+	variadic bool           // the last of argTypes is a ...T parameter
+	function bool           // registered by RegisterFunc, takes no receiver
+	optional int            // number of trailing arguments that may be omitted
+	minArgs  int            // number of arguments required, set by setOptional
+	maxArgs  int            // number of arguments accepted, -1 if unlimited
+	pool     sync.Pool      // of *[]reflect.Value, reused for params
+
+	paramNames []string // set by SetParamNames, for calls with named arguments
+	stream     bool     // the method returns a <-chan interface{} for CallStreaming
 }
 
 // Server represents an RPC Server.
 type Server struct {
-	lock       sync.RWMutex // protects the serviceMap
+	lock       sync.RWMutex // protects the serviceMap, interceptors, converters and shutdown
 	serviceMap map[string]*service
+	shutdown   bool           // set by Shutdown
+	inflight   sync.WaitGroup // calls in progress
+	errCode    int            // code reported for errors returned by functions
+	logger     Logger         // where errors are logged, the standard logger if nil
+	silent     bool           // discard all log output
+	workers    int            // maximum concurrent calls in a batch
+	verbose    bool           // give more details in error messages
+	maxCall    int            // maximum length of call strings, unlimited if 0
+
+	errMapper func(error) (code int, msg string)
+	onPanic   func(info CallInfo, recovered interface{}, stack []byte)
+	decorator func(Result) Result
+	enc       Encoding // JSONEncoding if nil
+	prefix    string   // set by SetIndent
+	indent    string
+	fields    *resultFields // set by SetResultFieldNames, nil for the defaults
+
+	interceptors []Interceptor
+	converters   map[reflect.Type]ConverterFunc // replaced, not modified, when a converter is added
+	lenientBools bool                           // accept numbers for booleans
+	ignoreExtra  bool                           // drop surplus trailing arguments
+	byteArrays   bool                           // encode []byte in Ret as arrays of numbers
+
+	recLock  sync.Mutex // serializes records written to recorder
+	recorder io.Writer
+
+	statsLock sync.Mutex // protects stats
+	stats     map[string]*MethodStats
 }
 
+// Logger is the interface used by Server to log errors.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// stdLogger writes to the standard logger of package log.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// discardLogger drops everything.
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, args ...interface{}) {}
+
+// Result is the outcome of a call, encoded as the result string.
+//
+// Ret may hold a json.RawMessage, for instance a cached response that is
+// already encoded. It is embedded in the JSON result as is, only validated
+// and compacted rather than encoded again, which is much cheaper for large
+// values.
 type Result struct {
 	Ret     interface{} `json:"ret"`
 	ErrCode int         `json:"err_code,omitempty"`
 	ErrMsg  string      `json:"err_msg,omitempty"`
+	ReqID   string      `json:"req_id,omitempty"` // set by CallWithID
+
+	// Extra holds additional envelope fields, such as a timestamp or the
+	// server version, typically set by a result decorator.
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+// Code returns the error code of the result as an ErrorCode.
+func (r Result) Code() ErrorCode {
+	return ErrorCode(r.ErrCode)
 }
 
 var typeOfResult = reflect.TypeOf((*Result)(nil))
+var typeOfResultValue = typeOfResult.Elem()
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+var typeOfStream = reflect.TypeOf((<-chan interface{})(nil))
 
 // NewServer returns a new Server.
 func NewServer() *Server {
-	return &Server{serviceMap: make(map[string]*service)}
+	return &Server{serviceMap: make(map[string]*service), errCode: int(FunctionError)}
+}
+
+// SetErrorMapper sets a function translating errors returned by functions
+// into the code and message of the Result, for errors that aren't an
+// *RPCError. If it returns a zero code, the code set by SetErrorCode is used.
+// By default, the message is err.Error(). It must not be called concurrently
+// with calls to the server.
+func (server *Server) SetErrorMapper(mapper func(err error) (code int, msg string)) {
+	server.errMapper = mapper
+}
+
+// SetPanicHandler sets a function called with the recovered value and the
+// stack trace when a function panics, for instance to report the panic to an
+// error tracker, before the InternalServerError result is built. A panic in
+// the handler itself is logged and otherwise ignored. It must not be called
+// concurrently with calls to the server.
+func (server *Server) SetPanicHandler(handler func(info CallInfo, recovered interface{}, stack []byte)) {
+	server.onPanic = handler
+}
+
+// SetMaxCallSize makes calls whose call string is longer than n bytes fail
+// with RequestTooLargeError, before the call string is parsed. If n <= 0, the
+// size is unlimited, which is the default. It must not be called concurrently
+// with calls to the server.
+func (server *Server) SetMaxCallSize(n int) {
+	server.maxCall = n
+}
+
+// SetIgnoreExtraArgs makes calls passing more arguments than a function
+// accepts drop the surplus trailing arguments instead of failing with
+// ParameterError, for instance during a rolling upgrade where newer clients
+// send parameters added since. It must not be called concurrently with calls
+// to the server.
+func (server *Server) SetIgnoreExtraArgs(ignore bool) {
+	server.ignoreExtra = ignore
+}
+
+// SetLogger sets the logger errors are reported to. A nil logger restores
+// the default, the standard logger of package log. It must not be called
+// concurrently with calls to the server.
+func (server *Server) SetLogger(l Logger) {
+	server.logger = l
+}
+
+// SetSilent turns off all logging by the server when silent is true. Errors
+// are still reported to callers in results. Since a client can trigger
+// errors at will, this prevents it from flooding the logs. It must not be
+// called concurrently with calls to the server.
+func (server *Server) SetSilent(silent bool) {
+	server.silent = silent
+}
+
+// output returns the logger errors are reported to.
+func (server *Server) output() Logger {
+	if server.silent {
+		return discardLogger{}
+	}
+	if server.logger == nil {
+		return stdLogger{}
+	}
+	return server.logger
+}
+
+func (server *Server) logf(format string, args ...interface{}) {
+	server.output().Printf(format, args...)
+}
+
+// SetVerboseErrors makes error messages sent to clients more detailed, for
+// instance listing the functions of a service when an unknown one is called.
+// This is off by default since it exposes more of the server to clients. It
+// must not be called concurrently with calls to the server.
+func (server *Server) SetVerboseErrors(verbose bool) {
+	server.verbose = verbose
+}
+
+// SetErrorCode sets the code reported when a function returning (T, error)
+// fails. It defaults to FunctionError. It must not be called concurrently
+// with calls to the server.
+func (server *Server) SetErrorCode(code int) {
+	server.errCode = code
 }
 
 // Is this an exported - upper case - name?
@@ -73,166 +265,1645 @@ func isExported(name string) bool {
 	return unicode.IsUpper(rune)
 }
 
+// Register publishes in the server the set of methods of the receiver value
+// that return a Result or a *Result, or one or more values followed by an
+// error. Several values are returned in Ret as an array, in declared order.
+// Methods promoted from embedded fields, by value or by pointer, are
+// published too; those with a pointer receiver need a pointer to the outer
+// struct when the field is embedded by value.
+// The service is registered under svcName; if svcName is empty, the concrete
+// type name of the receiver is used instead.
 func (server *Server) Register(rcvr interface{}, svcName string) error {
+	if svcName != "" {
+		return server.RegisterName(svcName, rcvr)
+	}
+	sname, err := server.typeName(rcvr)
+	if err != nil {
+		return err
+	}
+	return server.register(rcvr, sname, Options{})
+}
+
+// RegisterVerbose is like Register but also returns why each exported
+// method of rcvr that is not published was left out, such as "method bad
+// has wrong number of outs: 0", whether or not registration succeeded.
+func (server *Server) RegisterVerbose(rcvr interface{}, svcName string) (skipped []string, err error) {
+	sname := svcName
+	if sname == "" {
+		if sname, err = server.typeName(rcvr); err != nil {
+			return nil, err
+		}
+	}
+	err = server.register(rcvr, sname, Options{skipped: &skipped})
+	return skipped, err
+}
+
+// ValidateReceiver runs the checks of Register on rcvr without registering
+// it in any server, and returns the sorted names of the functions it would
+// publish, as they are called, or the error Register would return. Nothing
+// is logged.
+func ValidateReceiver(rcvr interface{}) (methods []string, err error) {
+	server := NewServer()
+	server.SetSilent(true)
+	name, err := server.typeName(rcvr)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.register(rcvr, name, Options{}); err != nil {
+		return nil, err
+	}
+	return server.serviceMap[name].methodNames(), nil
+}
+
+// typeName returns the name of the service registered for rcvr when no name
+// is given, the name of its concrete type.
+func (server *Server) typeName(rcvr interface{}) (string, error) {
+	if err := server.checkReceiver(rcvr); err != nil {
+		return "", err
+	}
+	sname := reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name()
+	if sname == "" {
+		s := "searpc.Register: no service name for type " + reflect.TypeOf(rcvr).String()
+		server.logf("%s", s)
+		return "", errors.New(s)
+	}
+	if !isExported(sname) {
+		s := "searpc.Register: type " + sname + " is not exported"
+		server.logf("%s", s)
+		return "", errors.New(s)
+	}
+	return sname, nil
+}
+
+// ReRegister is like Register, with the type name of rcvr as the service
+// name, but replaces the service registered under that name if there is
+// one, for instance to reload it. Calls in progress complete with the old
+// receiver; the settings made for the old service, such as by DisableMethod
+// or SetParamNames, are not carried over.
+func (server *Server) ReRegister(rcvr interface{}) error {
+	sname, err := server.typeName(rcvr)
+	if err != nil {
+		return err
+	}
+	return server.register(rcvr, sname, Options{replace: true})
+}
+
+// ReRegisterName is like ReRegister but registers the service under name.
+func (server *Server) ReRegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		s := "searpc.ReRegisterName: no service name for type " + reflect.TypeOf(rcvr).String()
+		server.logf("%s", s)
+		return errors.New(s)
+	}
+	return server.register(rcvr, name, Options{replace: true})
+}
+
+// RegisterName is like Register but uses the provided name for the service
+// instead of the receiver's concrete type, so that several instances of the
+// same type can be registered side by side. Calls to the service are
+// dispatched to rcvr itself, not to another value of its type. The name may
+// be dotted to group services, such as seafile.repo; it is matched whole.
+func (server *Server) RegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		s := "searpc.RegisterName: no service name for type " + reflect.TypeOf(rcvr).String()
+		server.logf("%s", s)
+		return errors.New(s)
+	}
+	return server.register(rcvr, name, Options{})
+}
+
+// Options are settings for the functions of a service, given at
+// registration.
+type Options struct {
+	// OptionalTrailing is the number of trailing parameters of each
+	// function that callers may omit, like libsearpc allows. Omitted
+	// arguments are passed as the zero value of their type. A variadic
+	// parameter is always optional and is not counted.
+	OptionalTrailing int
+
+	// Mapper, if not nil, gives the external name of each method from its
+	// Go name, the name callers then use.
+	Mapper func(goMethodName string) (externalName string)
+
+	only    reflect.Type // set by RegisterInterface, the interface to publish
+	replace bool         // set by ReRegister, replace a service of the same name
+	skipped *[]string    // set by RegisterVerbose, gets why methods are left out
+}
+
+// RPCNamer is implemented by receivers choosing the external names of their
+// methods, such as list-repos for ListAllRepos. The methods are published
+// under the names returned by RPCName for their Go names, unless a Mapper is
+// given in Options.
+type RPCNamer interface {
+	RPCName(goName string) string
+}
+
+var typeOfRPCNamer = reflect.TypeOf((*RPCNamer)(nil)).Elem()
+
+// RegisterInterface is like RegisterName but only publishes the methods of
+// impl declared by the interface iface, given as a nil pointer to it such as
+// (*RepoManager)(nil), leaving out the other exported methods of impl. impl
+// must implement iface.
+func (server *Server) RegisterInterface(name string, iface interface{}, impl interface{}) error {
+	typ := reflect.TypeOf(iface)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Interface {
+		s := fmt.Sprintf("searpc.RegisterInterface: %T is not a pointer to an interface", iface)
+		server.logf("%s", s)
+		return errors.New(s)
+	}
+	if impl == nil || !reflect.TypeOf(impl).Implements(typ) {
+		s := fmt.Sprintf("searpc.RegisterInterface: %T does not implement %s", impl, typ)
+		server.logf("%s", s)
+		return errors.New(s)
+	}
+	return server.RegisterNameWithOptions(name, impl, Options{only: typ})
+}
+
+// RegisterNameWithMapper is like RegisterName but publishes each method under
+// the name returned by mapper for its Go name, for instance get_repo for
+// GetRepo.
+func (server *Server) RegisterNameWithMapper(name string, rcvr interface{}, mapper func(goMethodName string) (externalName string)) error {
+	return server.RegisterNameWithOptions(name, rcvr, Options{Mapper: mapper})
+}
+
+// RegisterNameWithOptions is like RegisterName but applies opts to the
+// functions of the service.
+func (server *Server) RegisterNameWithOptions(name string, rcvr interface{}, opts Options) error {
+	if name == "" {
+		s := "searpc.RegisterNameWithOptions: no service name for type " + reflect.TypeOf(rcvr).String()
+		server.logf("%s", s)
+		return errors.New(s)
+	}
+	return server.register(rcvr, name, opts)
+}
+
+// RegisterAll registers each receiver in order under its type name, as
+// Register does. All receivers are tried; the returned error wraps the first
+// failure and identifies the receiver that caused it.
+func (server *Server) RegisterAll(rcvrs ...interface{}) error {
+	var first error
+	failed := 0
+	for i, rcvr := range rcvrs {
+		if err := server.Register(rcvr, ""); err != nil {
+			if first == nil {
+				first = fmt.Errorf("searpc.RegisterAll: receiver %d (%T): %w", i, rcvr, err)
+			}
+			failed++
+		}
+	}
+	if failed > 1 {
+		return fmt.Errorf("%w (and %d more failures)", first, failed-1)
+	}
+	return first
+}
+
+// checkReceiver returns an error if rcvr is not a struct or a pointer to a
+// struct.
+func (server *Server) checkReceiver(rcvr interface{}) error {
+	typ := reflect.TypeOf(rcvr)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ != nil && typ.Kind() == reflect.Struct {
+		return nil
+	}
+	got := "nil"
+	if rcvr != nil {
+		got = reflect.TypeOf(rcvr).String()
+	}
+	s := "searpc.Register: receiver must be a struct, got " + got
+	server.logf("%s", s)
+	return errors.New(s)
+}
+
+func (server *Server) register(rcvr interface{}, sname string, opts Options) error {
+	if err := server.checkReceiver(rcvr); err != nil {
+		return err
+	}
 	server.lock.Lock()
 	defer server.lock.Unlock()
 	if server.serviceMap == nil {
 		server.serviceMap = make(map[string]*service)
 	}
+	if _, present := server.serviceMap[sname]; present && !opts.replace {
+		return errors.New("searpc: service already defined: " + sname)
+	}
 	s := new(service)
 	s.typ = reflect.TypeOf(rcvr)
 	s.rcvr = reflect.ValueOf(rcvr)
+	s.name = sname
 
-	sname := ""
-	if svcName != "" {
-		sname = svcName
-	} else {
-		sname := reflect.Indirect(s.rcvr).Type().Name()
-		if sname == "" {
-			s := "searpc.Register: no service name for type " + s.typ.String()
-			log.Print(s)
-			return errors.New(s)
-		}
-		if !isExported(sname) {
-			s := "searpc.Register: type " + sname + " is not exported"
-			log.Print(s)
-			return errors.New(s)
+	// Install the methods
+	var skipped []error
+	s.method, skipped = suitableMethods(s.typ)
+	for _, err := range skipped {
+		server.output().Printf("%v", err)
+		if opts.skipped != nil {
+			*opts.skipped = append(*opts.skipped, err.Error())
 		}
-
 	}
-	if _, present := server.serviceMap[sname]; present {
-		return errors.New("searpc: service already defined: " + sname)
+	if opts.only != nil {
+		for mname, mt := range s.method {
+			if _, ok := opts.only.MethodByName(mt.method.Name); !ok {
+				delete(s.method, mname)
+			}
+		}
+		for i := 0; i < opts.only.NumMethod(); i++ {
+			if m := opts.only.Method(i); s.method[strings.ToLower(m.Name)] == nil {
+				str := "searpc.RegisterInterface: method " + m.Name + " of " + opts.only.String() + " is not suitable"
+				server.logf("%s", str)
+				return errors.New(str)
+			}
+		}
 	}
-	s.name = sname
 
-	// Install the methods
-	s.method = suitableMethods(s.typ, true)
+	// To help the user, see if a pointer receiver would expose more.
+	var ptrOnly []string
+	if s.typ.Kind() != reflect.Ptr {
+		ptrMethods, _ := suitableMethods(reflect.PtrTo(s.typ))
+		for mname, mt := range ptrMethods {
+			if opts.only != nil {
+				if _, ok := opts.only.MethodByName(mt.method.Name); !ok {
+					continue
+				}
+			}
+			if s.method[mname] == nil {
+				ptrOnly = append(ptrOnly, mname)
+			}
+		}
+		sort.Strings(ptrOnly)
+		if opts.skipped != nil {
+			for _, mname := range ptrOnly {
+				*opts.skipped = append(*opts.skipped, "method "+mname+" has a pointer receiver (hint: pass a *"+s.typ.String()+" instead)")
+			}
+		}
+	}
 
 	if len(s.method) == 0 {
 		str := ""
-
-		// To help the user, see if a pointer receiver would work.
-		method := suitableMethods(reflect.PtrTo(s.typ), false)
-		if len(method) != 0 {
-			str = "searpc.Register: type " + sname + " has no exported methods of suitable type (hint: pass a pointer to value of that type)"
+		if len(ptrOnly) != 0 {
+			str = "searpc.Register: type " + sname + " has no exported methods of suitable type (hint: methods " + strings.Join(ptrOnly, ", ") + " have pointer receivers, pass a *" + s.typ.String() + " instead)"
 		} else {
 			str = "searpc.Register: type " + sname + " has no exported methods of suitable type"
 		}
-		log.Print(str)
+		server.logf("%s", str)
 		return errors.New(str)
 	}
+	for _, mt := range s.method {
+		mt.setOptional(opts.OptionalTrailing)
+	}
+	mapper := opts.Mapper
+	if namer, ok := rcvr.(RPCNamer); ok && mapper == nil {
+		mapper = namer.RPCName
+	}
+	if mapper != nil {
+		methods := make(map[string]*methodType, len(s.method))
+		for _, mt := range s.method {
+			ename := strings.ToLower(mapper(mt.method.Name))
+			if ename == "" {
+				str := "searpc.Register: no external name for method " + mt.method.Name + " of type " + sname
+				server.logf("%s", str)
+				return errors.New(str)
+			}
+			if other := methods[ename]; other != nil {
+				str := "searpc.Register: methods " + other.method.Name + " and " + mt.method.Name + " of type " + sname + " are both named " + ename
+				server.logf("%s", str)
+				return errors.New(str)
+			}
+			mt.name = ename
+			methods[ename] = mt
+		}
+		s.method = methods
+	}
+	if len(ptrOnly) != 0 {
+		server.logf("searpc.Register: methods %s of type %s have pointer receivers and are not registered (hint: pass a *%s instead)", strings.Join(ptrOnly, ", "), sname, s.typ)
+	}
 	server.serviceMap[s.name] = s
 	return nil
 }
 
-// suitableMethods returns suitable Rpc methods of typ, it will report
-// error using log if reportErr is true.
-func suitableMethods(typ reflect.Type, reportErr bool) map[string]*reflect.Method {
-	methods := make(map[string]*reflect.Method)
+// Unregister removes the service registered under name.
+func (server *Server) Unregister(name string) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if _, present := server.serviceMap[name]; !present {
+		return errors.New("searpc: service not defined: " + name)
+	}
+	delete(server.serviceMap, name)
+	return nil
+}
+
+// Registered reports whether a service is registered under name.
+func (server *Server) Registered(name string) bool {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	_, present := server.serviceMap[name]
+	return present
+}
+
+// Reset unregisters all services, and drops the interceptors, the converters
+// and the statistics recorded by MetricsInterceptor. Calls in progress are not
+// affected.
+func (server *Server) Reset() {
+	server.lock.Lock()
+	server.serviceMap = make(map[string]*service)
+	server.interceptors = nil
+	server.converters = nil
+	server.lock.Unlock()
+
+	server.statsLock.Lock()
+	server.stats = nil
+	server.statsLock.Unlock()
+}
+
+// Shutdown makes the server reject new calls with ShuttingDownError, then
+// waits for the calls in progress to complete. If ctx expires first,
+// Shutdown returns its error; the calls still in progress are not
+// interrupted.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.lock.Lock()
+	server.shutdown = true
+	server.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		server.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Services returns the sorted names of the registered services, so that
+// dotted names sharing a prefix are listed together.
+func (server *Server) Services() []string {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	names := make([]string, 0, len(server.serviceMap))
+	for name := range server.serviceMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Methods returns the sorted names of the functions of the named service, as
+// they are called in call strings.
+func (server *Server) Methods(serviceName string) ([]string, error) {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	service := server.serviceMap[serviceName]
+	if service == nil {
+		return nil, errors.New("searpc: service not defined: " + serviceName)
+	}
+	return service.methodNames(), nil
+}
+
+// methodNames returns the sorted names of the functions of s. The server
+// lock must be held.
+func (s *service) methodNames() []string {
+	names := make([]string, 0, len(s.method)+len(s.overloads))
+	for name := range s.method {
+		names = append(names, name)
+	}
+	for name := range s.overloads {
+		if s.method[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MethodSignature returns the types of the parameters that calls to the
+// named function must supply. The receiver and a leading context.Context
+// parameter are not included, since they don't appear in call strings.
+func (server *Server) MethodSignature(serviceName, methodName string) (params []reflect.Type, err error) {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	service := server.serviceMap[serviceName]
+	if service == nil {
+		return nil, errors.New("searpc: service not defined: " + serviceName)
+	}
+	method := service.method[strings.ToLower(methodName)]
+	if method == nil {
+		return nil, errors.New("searpc: function not defined: " + methodName)
+	}
+	return append([]reflect.Type(nil), method.argTypes...), nil
+}
+
+// FuncType returns the type of the named function as seen by call strings:
+// its parameters are those returned by MethodSignature and its results are
+// those of the registered method or function.
+func (server *Server) FuncType(serviceName, methodName string) (reflect.Type, error) {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	service := server.serviceMap[serviceName]
+	if service == nil {
+		return nil, errors.New("searpc: service not defined: " + serviceName)
+	}
+	method := service.method[strings.ToLower(methodName)]
+	if method == nil {
+		return nil, errors.New("searpc: function not defined: " + methodName)
+	}
+	ftype := method.method.Type
+	out := make([]reflect.Type, ftype.NumOut())
+	for i := range out {
+		out[i] = ftype.Out(i)
+	}
+	return reflect.FuncOf(method.argTypes, out, method.variadic), nil
+}
+
+// DisableMethod turns off the named function of a service: calls to it fail
+// with MethodDisabledError until EnableMethod is called.
+func (server *Server) DisableMethod(serviceName, methodName string) error {
+	return server.setDisabled(serviceName, methodName, true)
+}
+
+// EnableMethod turns back on a function turned off by DisableMethod.
+func (server *Server) EnableMethod(serviceName, methodName string) error {
+	return server.setDisabled(serviceName, methodName, false)
+}
+
+func (server *Server) setDisabled(serviceName, methodName string, disabled bool) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	service := server.serviceMap[serviceName]
+	if service == nil {
+		return errors.New("searpc: service not defined: " + serviceName)
+	}
+	mname := strings.ToLower(methodName)
+	if service.method[mname] == nil {
+		return errors.New("searpc: function not defined: " + methodName)
+	}
+	if !disabled {
+		delete(service.disabled, mname)
+		return nil
+	}
+	if service.disabled == nil {
+		service.disabled = make(map[string]bool)
+	}
+	service.disabled[mname] = true
+	return nil
+}
+
+// SetMaxConcurrency limits the number of calls to the named service that
+// run at the same time to n. Further calls wait for a call in progress to
+// complete, or fail with BusyError if SetFailWhenBusy was called. If n <= 0,
+// the number of calls is not limited, which is the default.
+func (server *Server) SetMaxConcurrency(serviceName string, n int) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	service := server.serviceMap[serviceName]
+	if service == nil {
+		return errors.New("searpc: service not defined: " + serviceName)
+	}
+	if n <= 0 {
+		service.slots = nil
+	} else {
+		service.slots = make(chan struct{}, n)
+	}
+	return nil
+}
+
+// SetFailWhenBusy makes calls to the named service fail with BusyError,
+// instead of waiting, when the limit set by SetMaxConcurrency is reached.
+func (server *Server) SetFailWhenBusy(serviceName string, fail bool) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	service := server.serviceMap[serviceName]
+	if service == nil {
+		return errors.New("searpc: service not defined: " + serviceName)
+	}
+	service.failBusy = fail
+	return nil
+}
+
+// SetFallback makes calls to functions the named service doesn't have run
+// fn, instead of failing with FunctionNotFoundError, for instance to proxy
+// them to another server. fn is called with the lowercase function name and
+// the decoded arguments, numbers being float64. A nil fn removes the
+// fallback.
+func (server *Server) SetFallback(serviceName string, fn func(funcName string, args []interface{}) Result) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	service := server.serviceMap[serviceName]
+	if service == nil {
+		return errors.New("searpc: service not defined: " + serviceName)
+	}
+	service.fallback = fn
+	return nil
+}
+
+// suitableMethods returns suitable Rpc methods of typ, and why the other
+// exported methods are not. The RPCName method of an RPCNamer is left out
+// silently.
+func suitableMethods(typ reflect.Type) (map[string]*methodType, []error) {
+	methods := make(map[string]*methodType)
+	var skipped []error
+	namer := typ.Implements(typeOfRPCNamer)
 	for m := 0; m < typ.NumMethod(); m++ {
 		method := typ.Method(m)
-		mtype := method.Type
+		if namer && method.Name == "RPCName" {
+			continue
+		}
 		mname := strings.ToLower(method.Name)
-		// Method needs one out.
-		if mtype.NumOut() != 1 {
-			if reportErr {
-				log.Println("method", mname, "has wrong number of outs:", mtype.NumOut())
-			}
+		// Parameter 0 is the receiver.
+		mt, err := newMethodType(mname, method.Type, 1)
+		if err != nil {
+			skipped = append(skipped, err)
 			continue
 		}
-		// The return type of the method must be Result.
-		if returnType := mtype.Out(0); returnType != typeOfResult {
-			if reportErr {
-				log.Println("method", mname, "returns", returnType.String(), "not Result")
+		mt.name = mname
+		mt.method = method
+		methods[mname] = mt
+	}
+	return methods, skipped
+}
+
+// newMethodType checks that a function of type ftype, whose parameters
+// starting at first are supplied by callers, can be called through the
+// server, and returns its description.
+func newMethodType(mname string, ftype reflect.Type, first int) (*methodType, error) {
+	mt := new(methodType)
+	// Method needs one out, or several if the last is an error.
+	switch nout := ftype.NumOut(); nout {
+	case 0:
+		return nil, fmt.Errorf("method %s has wrong number of outs: %d", mname, nout)
+	case 1:
+		// The return type of the method must be Result, or a stream.
+		returnType := ftype.Out(0)
+		if returnType != typeOfResult && returnType != typeOfResultValue && returnType != typeOfStream {
+			return nil, fmt.Errorf("method %s must return searpc.Result or *searpc.Result, not %s", mname, returnType)
+		}
+		mt.stream = returnType == typeOfStream
+	case 2:
+		if returnType := ftype.Out(1); returnType != typeOfError {
+			return nil, fmt.Errorf("method %s returns %s as second out, not error", mname, returnType)
+		}
+		mt.retErr = true
+		mt.stream = ftype.Out(0) == typeOfStream
+	default:
+		if returnType := ftype.Out(nout - 1); returnType != typeOfError {
+			return nil, fmt.Errorf("method %s returns %s as last out, not error", mname, returnType)
+		}
+		mt.retErr = true
+	}
+
+	argStart := first
+	if ftype.NumIn() > first && ftype.In(first) == typeOfContext {
+		mt.hasCtx = true
+		argStart++
+	}
+	for i := argStart; i < ftype.NumIn(); i++ {
+		if !decodable(ftype.In(i)) {
+			return nil, fmt.Errorf("method %s parameter %d has type %s, which can't be decoded from a call", mname, i-argStart+1, ftype.In(i))
+		}
+		mt.argTypes = append(mt.argTypes, ftype.In(i))
+	}
+	mt.variadic = ftype.IsVariadic()
+	mt.setOptional(0)
+	return mt, nil
+}
+
+// RegisterFunc publishes fn as function funcName of the named service. fn
+// must be a function following the same conventions as methods passed to
+// Register. The service is created if it doesn't exist yet.
+func (server *Server) RegisterFunc(serviceName, funcName string, fn interface{}) error {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		s := "searpc.RegisterFunc: " + funcName + " is not a function"
+		server.logf("%s", s)
+		return errors.New(s)
+	}
+	mt, err := funcMethodType(funcName, fv)
+	if err != nil {
+		s := "searpc.RegisterFunc: " + err.Error()
+		server.logf("%s", s)
+		return errors.New(s)
+	}
+	return server.addFuncs(serviceName, map[string]*methodType{strings.ToLower(funcName): mt})
+}
+
+// RegisterDynamic publishes handlers as functions of the named service, for
+// dispatch tables built at run time. Each handler is called with the
+// arguments decoded from the call string, numbers being float64 even when
+// they are integers. The service is created if it doesn't exist yet. No
+// handler is registered if one of them conflicts with a function of the
+// service.
+func (server *Server) RegisterDynamic(serviceName string, handlers map[string]func([]interface{}) Result) error {
+	mts := make(map[string]*methodType, len(handlers))
+	for name, h := range handlers {
+		h := h
+		fv := reflect.ValueOf(func(args ...interface{}) *Result {
+			res := h(args)
+			return &res
+		})
+		mt, err := funcMethodType(name, fv)
+		if err != nil {
+			return err
+		}
+		mts[strings.ToLower(name)] = mt
+	}
+	return server.addFuncs(serviceName, mts)
+}
+
+// funcMethodType describes the function fv, named funcName.
+func funcMethodType(funcName string, fv reflect.Value) (*methodType, error) {
+	mt, err := newMethodType(strings.ToLower(funcName), fv.Type(), 0)
+	if err != nil {
+		return nil, err
+	}
+	mt.method = reflect.Method{Name: funcName, Type: fv.Type(), Func: fv}
+	mt.name = strings.ToLower(funcName)
+	mt.function = true
+	return mt, nil
+}
+
+// fallbackMethod describes a call of function funcName handled by fallback.
+func fallbackMethod(funcName string, fallback func(string, []interface{}) Result) *methodType {
+	mt, _ := funcMethodType(funcName, reflect.ValueOf(func(args ...interface{}) *Result {
+		res := fallback(funcName, args)
+		return &res
+	}))
+	return mt
+}
+
+// addFuncs adds the functions mts, keyed by lowercase name, to the named
+// service, creating it if needed. Either all of them are added or none.
+func (server *Server) addFuncs(serviceName string, mts map[string]*methodType) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	s := server.serviceMap[serviceName]
+	for fname := range mts {
+		if s != nil && s.method[fname] != nil {
+			return errors.New("searpc: function already defined: " + serviceName + "." + fname)
+		}
+	}
+	if server.serviceMap == nil {
+		server.serviceMap = make(map[string]*service)
+	}
+	if s == nil {
+		s = &service{name: serviceName, method: make(map[string]*methodType)}
+		server.serviceMap[serviceName] = s
+	}
+	for fname, mt := range mts {
+		s.method[fname] = mt
+	}
+	return nil
+}
+
+// overload chooses among the functions sharing a name the first one that
+// accepts n arguments, trying method, which may be nil, before the aliases.
+// If none does, one of them is returned to report the mismatch.
+func overload(method *methodType, aliases []*methodType, n int) *methodType {
+	if method != nil && method.accepts(n) {
+		return method
+	}
+	for _, mt := range aliases {
+		if mt.accepts(n) {
+			return mt
+		}
+	}
+	if method != nil {
+		return method
+	}
+	return aliases[0]
+}
+
+// AliasFunc makes function methodName of the named service callable as
+// externalName too. Several functions, with different numbers of parameters,
+// may share an external name, including the name of a function of the
+// service: a call runs the first one, in the order of registration, that
+// accepts the number of arguments in the call string.
+func (server *Server) AliasFunc(serviceName, externalName, methodName string) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	service := server.serviceMap[serviceName]
+	if service == nil {
+		return errors.New("searpc: service not defined: " + serviceName)
+	}
+	mt := service.method[strings.ToLower(methodName)]
+	if mt == nil {
+		return errors.New("searpc: function not defined: " + methodName)
+	}
+	ename := strings.ToLower(externalName)
+	if service.method[ename] == mt {
+		return errors.New("searpc: function " + methodName + " is already named " + externalName)
+	}
+	for _, alias := range service.overloads[ename] {
+		if alias == mt {
+			return errors.New("searpc: function " + methodName + " is already named " + externalName)
+		}
+	}
+	if service.overloads == nil {
+		service.overloads = make(map[string][]*methodType)
+	}
+	service.overloads[ename] = append(service.overloads[ename], mt)
+	return nil
+}
+
+// invoke calls method with params for the call described by info. A panic in
+// the method is recovered and turned into an InternalServerError result, so
+// that the server stays usable.
+func (server *Server) invoke(info CallInfo, mtype *methodType, params []reflect.Value) (res Result) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			if server.onPanic != nil {
+				server.panicked(info, r, stack)
 			}
-			continue
+			errStr := fmt.Sprintf("Function %s panicked: %v", mtype.name, r)
+			server.logf("%s\n%s", errStr, stack)
+			res = Result{ErrCode: int(InternalServerError), ErrMsg: errStr}
 		}
+	}()
+	out := mtype.method.Func.Call(params)
+	if mtype.retErr {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return server.errorResult(err)
+		}
+		if len(out) > 2 {
+			// Several values are returned as an array in declared order.
+			ret := make([]interface{}, len(out)-1)
+			for i := range ret {
+				ret[i] = out[i].Interface()
+			}
+			return Result{Ret: ret}
+		}
+		if t := out[0].Type(); t != typeOfResult && t != typeOfResultValue {
+			return Result{Ret: out[0].Interface()}
+		}
+	}
+	switch {
+	case mtype.stream:
+		return Result{Ret: out[0].Interface()}
+	case out[0].Type() == typeOfResultValue:
+		return out[0].Interface().(Result)
+	}
+	// A nil *Result is an empty result.
+	if ret := out[0].Interface().(*Result); ret != nil {
+		res = *ret
+	}
+	return
+}
+
+// panicked passes a panic to the panic handler, guarding against the
+// handler panicking too.
+func (server *Server) panicked(info CallInfo, r interface{}, stack []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			server.logf("Panic handler panicked: %v", r)
+		}
+	}()
+	server.onPanic(info, r, stack)
+}
 
-		regMethod := method
-		methods[mname] = &regMethod
+// retError reports an error put in the Ret of res by mistake as the error of
+// the result, as if the function had returned it, instead of encoding it as
+// an empty object. A code already set in res is kept.
+func (server *Server) retError(res Result) Result {
+	err, ok := res.Ret.(error)
+	if !ok {
+		return res
+	}
+	errRes := server.errorResult(err)
+	if res.ErrCode != 0 {
+		errRes.ErrCode = res.ErrCode
 	}
-	return methods
+	if res.ErrMsg != "" {
+		errRes.ErrMsg = res.ErrMsg
+	}
+	errRes.ReqID, errRes.Extra = res.ReqID, res.Extra
+	return errRes
 }
 
-const (
-	ServiceNotFoundError  = 501
-	FunctionNotFoundError = 500
-	ParseJSONError        = 511
-	ParameterError        = 512
-)
+// errorResult turns an error returned by a function into a Result.
+func (server *Server) errorResult(err error) Result {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return Result{ErrCode: rpcErr.ErrCode, ErrMsg: rpcErr.ErrMsg}
+	}
+	code, msg := 0, err.Error()
+	if server.errMapper != nil {
+		code, msg = server.errMapper(err)
+	}
+	if code == 0 {
+		code = server.errCode
+	}
+	if code == 0 {
+		code = int(FunctionError)
+	}
+	return Result{ErrCode: code, ErrMsg: msg}
+}
 
+// Call invokes the function described by callStr on the named service and
+// returns the encoded Result.
+//
+// A call string may end with an options object, {"deadline_ms": n}, which
+// is not passed as an argument unless the function takes one more argument.
+// The call then gets a context with a timeout of n milliseconds, seen by
+// functions taking a context and while waiting for a concurrency slot.
 func (server *Server) Call(serviceName string, callStr []byte) (retStr []byte) {
-	var res *Result
-	var errStr string
-	var errCode int
+	return server.CallContext(context.Background(), serviceName, callStr)
+}
+
+// CallContext is like Call but passes ctx to functions whose first parameter
+// is a context.Context. That parameter is not included in callStr.
+func (server *Server) CallContext(ctx context.Context, serviceName string, callStr []byte) (retStr []byte) {
+	res, _ := server.callContext(ctx, serviceName, callStr)
+	retStr = server.encode(res)
+	server.record(serviceName, callStr, "", retStr)
+	return retStr
+}
+
+// metaKey is the context key under which CallContextMeta stores metadata.
+type metaKey struct{}
+
+// CallContextMeta is like CallContext but also stores meta, request metadata
+// such as an authentication token or a locale, in the context passed to
+// functions, where MetaFromContext retrieves it.
+func (server *Server) CallContextMeta(ctx context.Context, serviceName string, callStr []byte, meta map[string]string) []byte {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return server.CallContext(context.WithValue(ctx, metaKey{}, meta), serviceName, callStr)
+}
+
+// MetaFromContext returns the metadata stored in ctx by CallContextMeta, or
+// nil if there is none.
+func MetaFromContext(ctx context.Context) map[string]string {
+	meta, _ := ctx.Value(metaKey{}).(map[string]string)
+	return meta
+}
+
+// CallWithID is like Call but stamps the returned Result with the request ID
+// id, so that clients can trace calls. An empty id is omitted.
+func (server *Server) CallWithID(serviceName string, callStr []byte, id string) []byte {
+	retStr := server.callWithID(serviceName, callStr, id)
+	server.record(serviceName, callStr, id, retStr)
+	return retStr
+}
+
+// callWithID is CallWithID without recording the call. An empty id is left
+// out of the result, as by Call.
+func (server *Server) callWithID(serviceName string, callStr []byte, id string) []byte {
+	res, _ := server.callContext(context.Background(), serviceName, callStr)
+	res.ReqID = id
+	return server.encode(res)
+}
+
+// encode marshals res with the encoding of the server. If res can't be
+// encoded, an InternalServerError result is returned instead.
+func (server *Server) encode(res Result) []byte {
+	enc := server.encoding()
+	if server.byteArrays {
+		res.Ret = bytesAsArray(res.Ret)
+	}
+	retStr, err := server.marshal(enc, server.decorate(res))
+	if err != nil {
+		res, _ = server.failure(InternalServerError, "Failed to encode result: "+err.Error())
+		retStr, _ = server.marshal(enc, server.decorate(res))
+	}
+	return retStr
+}
+
+// SetByteSliceAsArray makes a []byte returned in Ret, alone or among several
+// values, encoded as an array of numbers rather than as a base64 string, for
+// callers that expect one. It must not be called concurrently with calls to
+// the server.
+func (server *Server) SetByteSliceAsArray(asArray bool) {
+	server.byteArrays = asArray
+}
+
+// bytesAsArray returns ret with the []byte values it holds, at the top
+// level, converted to []int.
+func bytesAsArray(ret interface{}) interface{} {
+	switch v := ret.(type) {
+	case []byte:
+		ints := make([]int, len(v))
+		for i, b := range v {
+			ints[i] = int(b)
+		}
+		return ints
+	case []interface{}:
+		var values []interface{}
+		for i, elem := range v {
+			if b, ok := elem.([]byte); ok {
+				if values == nil {
+					// Leave the slice of the function alone.
+					values = append([]interface{}(nil), v...)
+				}
+				values[i] = bytesAsArray(b)
+			}
+		}
+		if values != nil {
+			return values
+		}
+	}
+	return ret
+}
+
+// SetResultDecorator sets a function transforming every Result before it is
+// encoded, whether it is returned by a function or reports a failure of the
+// framework, for instance to add envelope fields in Extra. It must not be
+// called concurrently with calls to the server.
+func (server *Server) SetResultDecorator(decorator func(Result) Result) {
+	server.decorator = decorator
+}
+
+func (server *Server) decorate(res Result) Result {
+	if server.decorator == nil {
+		return res
+	}
+	return server.decorator(res)
+}
+
+// CallTimeout is like Call but gives up waiting for the function after d,
+// returning a TimeoutError result. Functions taking a context.Context see it
+// cancelled at that point, others are not interrupted: the function may
+// keep running in the background after CallTimeout has returned.
+func (server *Server) CallTimeout(serviceName string, callStr []byte, d time.Duration) (retStr []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	done := make(chan []byte, 1)
+	go func() {
+		done <- server.CallContext(ctx, serviceName, callStr)
+	}()
+	select {
+	case retStr = <-done:
+	case <-ctx.Done():
+		res, _ := server.failure(TimeoutError, "Call timed out after "+d.String())
+		retStr = server.encode(res)
+	}
+	return
+}
+
+// CallResult is like Call but returns the Result unencoded. Failures of the
+// framework itself, such as an unknown service or function, a malformed
+// call string, mismatching parameters or a busy service, are also reported
+// as a non-nil error. Errors set by the function in its Result are not.
+func (server *Server) CallResult(serviceName string, callStr []byte) (Result, error) {
+	return server.callContext(context.Background(), serviceName, callStr)
+}
+
+// CallTyped is like Call but returns the value the function returned, without
+// encoding it. A non-zero error code, whether set by the framework or by the
+// function, is returned as an *RPCError.
+func (server *Server) CallTyped(serviceName string, callStr []byte) (interface{}, error) {
+	res, _ := server.callContext(context.Background(), serviceName, callStr)
+	if res.ErrCode != 0 {
+		return nil, &RPCError{ErrCode: res.ErrCode, ErrMsg: res.ErrMsg}
+	}
+	return res.Ret, nil
+}
+
+// failure logs errStr and reports it both as a Result with errCode and as
+// an error.
+func (server *Server) failure(errCode ErrorCode, errStr string) (Result, error) {
+	server.logf("%s", errStr)
+	return Result{ErrCode: int(errCode), ErrMsg: errStr}, errors.New(errStr)
+}
+
+func (server *Server) callContext(ctx context.Context, serviceName string, callStr []byte) (Result, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !server.enter() {
+		return server.failure(ShuttingDownError, "Server is shutting down")
+	}
+	defer server.inflight.Done()
+
+	service, funcName, args, rpcErr := server.parse(serviceName, callStr)
+	if rpcErr != nil {
+		return server.reject(rpcErr)
+	}
+	return server.dispatchService(ctx, service, funcName, args, callStr)
+}
+
+// CallStreaming invokes the function described by callStr on the named
+// service and writes its results to w, one encoded Result per line. Functions
+// returning a <-chan interface{}, possibly along with an error, stream a
+// Result for each value received until the channel is closed; other
+// functions write a single Result. The context passed to the function is
+// canceled when CallStreaming returns, so that it can stop sending if
+// writing to w fails.
+func (server *Server) CallStreaming(serviceName string, callStr []byte, w io.Writer) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !server.enter() {
+		res, _ := server.failure(ShuttingDownError, "Server is shutting down")
+		return server.writeFrame(w, res)
+	}
+	defer server.inflight.Done()
+
+	c, rpcErr := server.prepare(ctx, serviceName, callStr)
+	if rpcErr != nil {
+		res, _ := server.reject(rpcErr)
+		return server.writeFrame(w, res)
+	}
+	defer c.release()
+	res, _ := server.run(CallInfo{Service: serviceName, Method: c.funcName, CallStr: callStr, Args: c.args}, c)
+	ch, ok := res.Ret.(<-chan interface{})
+	if !c.method.stream || !ok || res.ErrCode != 0 {
+		return server.writeFrame(w, res)
+	}
+	if ch == nil {
+		// A nil channel is taken as closed rather than blocking forever.
+		return nil
+	}
+	for v := range ch {
+		if err := server.writeFrame(w, Result{Ret: v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFrame writes res, encoded, on a line of w.
+func (server *Server) writeFrame(w io.Writer, res Result) error {
+	_, err := w.Write(append(server.encode(res), '\n'))
+	return err
+}
+
+// CallLocal calls funcName of the named service with args, for callers in
+// the same process. No encoding is involved: args are passed as they are
+// when they are assignable to the parameter types and converted as decoded
+// arguments otherwise, and the value returned by the function is returned
+// as is. Interceptors see a nil CallStr. A non-zero error code is returned as
+// an *RPCError.
+func (server *Server) CallLocal(serviceName, funcName string, args ...interface{}) (interface{}, error) {
+	if !server.enter() {
+		res, _ := server.failure(ShuttingDownError, "Server is shutting down")
+		return nil, &RPCError{ErrCode: res.ErrCode, ErrMsg: res.ErrMsg}
+	}
+	defer server.inflight.Done()
+
+	service, rpcErr := server.lookup(serviceName)
+	var c *preparedCall
+	if rpcErr == nil {
+		c, rpcErr = server.resolve(context.Background(), service, strings.ToLower(funcName), args, true)
+	}
+	if rpcErr != nil {
+		server.reject(rpcErr)
+		return nil, rpcErr
+	}
+	res, _ := server.run(CallInfo{Service: serviceName, Method: c.funcName, Args: args}, c)
+	if res.ErrCode != 0 {
+		return nil, &RPCError{ErrCode: res.ErrCode, ErrMsg: res.ErrMsg}
+	}
+	return res.Ret, nil
+}
+
+// CallArgs is like Call for callers having the arguments decoded already,
+// such as from the JSON call array of a higher-level router: args are
+// converted as the arguments of a call string would be. Interceptors see a
+// nil CallStr and the call isn't written to the recorder.
+func (server *Server) CallArgs(serviceName, funcName string, args []interface{}) []byte {
+	return server.encode(server.dispatch(serviceName, funcName, args))
+}
+
+// dispatch calls funcName of the named service with rawArgs, decoded from a
+// call array, and returns its Result.
+func (server *Server) dispatch(serviceName, funcName string, rawArgs []interface{}) Result {
+	if !server.enter() {
+		res, _ := server.failure(ShuttingDownError, "Server is shutting down")
+		return res
+	}
+	defer server.inflight.Done()
+
+	service, rpcErr := server.lookup(serviceName)
+	if rpcErr != nil {
+		res, _ := server.reject(rpcErr)
+		return res
+	}
+	res, _ := server.dispatchService(context.Background(), service, funcName, rawArgs, nil)
+	return res
+}
+
+// dispatchService is dispatch for a service looked up already, along with an
+// error if the call failed before reaching the function. Interceptors see
+// callStr, the call string rawArgs come from if any. The call must be in
+// progress, as counted by enter.
+func (server *Server) dispatchService(ctx context.Context, service *service, funcName string, rawArgs []interface{}, callStr []byte) (Result, error) {
+	c, rpcErr := server.resolve(ctx, service, strings.ToLower(funcName), rawArgs, false)
+	if rpcErr != nil {
+		return server.reject(rpcErr)
+	}
+	defer c.release()
+	if c.method.stream {
+		return server.failure(FunctionNotFoundError, "Function "+c.funcName+" streams its results, use CallStreaming")
+	}
+	info := CallInfo{Service: service.name, Method: c.funcName, CallStr: callStr, Args: c.args}
+	return server.run(info, c)
+}
 
+// lookup returns the service registered under serviceName.
+func (server *Server) lookup(serviceName string) (*service, *RPCError) {
+	server.lock.RLock()
 	service := server.serviceMap[serviceName]
+	server.lock.RUnlock()
 	if service == nil {
-		res = &Result{ErrCode: ServiceNotFoundError, ErrMsg: "Cannot find service " + serviceName}
-		retStr, _ = json.Marshal(*res)
-		return
+		return nil, &RPCError{ErrCode: int(ServiceNotFoundError), ErrMsg: "Cannot find service " + serviceName}
+	}
+	return service, nil
+}
+
+// enter reports whether the server accepts calls, the call then being in
+// progress until inflight.Done is called.
+func (server *Server) enter() bool {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	if server.shutdown {
+		return false
+	}
+	// Adding under the lock guarantees Shutdown sees every call.
+	server.inflight.Add(1)
+	return true
+}
+
+// reject reports a call that failed before invoking the function, logging
+// it unless the service is unknown.
+func (server *Server) reject(rpcErr *RPCError) (Result, error) {
+	if ErrorCode(rpcErr.ErrCode) == ServiceNotFoundError {
+		return Result{ErrCode: rpcErr.ErrCode, ErrMsg: rpcErr.ErrMsg}, errors.New(rpcErr.ErrMsg)
+	}
+	return server.failure(ErrorCode(rpcErr.ErrCode), rpcErr.ErrMsg)
+}
+
+// run invokes the prepared call c through the interceptors, once a slot is
+// available if the concurrency of the service is limited. The error is
+// non-nil if no slot was available for the last invocation.
+func (server *Server) run(info CallInfo, c *preparedCall) (Result, error) {
+	ctx := c.ctx
+	defer c.method.putParams(c.params)
+	var busyErr error
+	res := intercept(c.interceptors, info, func() (res Result) {
+		busyErr = nil
+		if c.slots != nil {
+			if c.failBusy {
+				select {
+				case c.slots <- struct{}{}:
+				default:
+					res, busyErr = server.failure(BusyError, "Service "+info.Service+" is busy")
+					return res
+				}
+			} else {
+				select {
+				case c.slots <- struct{}{}:
+				case <-ctx.Done():
+					res, busyErr = server.failure(BusyError, "Service "+info.Service+" is busy: "+ctx.Err().Error())
+					return res
+				}
+			}
+			defer func() { <-c.slots }()
+		}
+		return server.retError(server.invoke(info, c.method, *c.params))
+	})
+	c.method.health.record(res)
+	return res, busyErr
+}
+
+// Validate checks the call described by callStr as Call would, from parsing
+// to argument conversion, without invoking the function. It returns nil if
+// the call is valid, or an *RPCError with the code and message Call would
+// have reported.
+func (server *Server) Validate(serviceName string, callStr []byte) error {
+	c, rpcErr := server.prepare(context.Background(), serviceName, callStr)
+	if rpcErr != nil {
+		return rpcErr
+	}
+	c.method.putParams(c.params)
+	c.release()
+	return nil
+}
+
+// preparedCall is a call that has been parsed and checked, ready to invoke.
+type preparedCall struct {
+	ctx          context.Context    // passed to the function
+	cancel       context.CancelFunc // releases ctx if it has a deadline from the call string
+	funcName     string
+	args         []interface{} // decoded arguments
+	method       *methodType
+	params       *[]reflect.Value // from method.pool
+	slots        chan struct{}
+	failBusy     bool
+	interceptors []Interceptor
+}
+
+// prepare parses callStr, looks up the function and converts its arguments.
+func (server *Server) prepare(ctx context.Context, serviceName string, callStr []byte) (*preparedCall, *RPCError) {
+	service, funcName, args, rpcErr := server.parse(serviceName, callStr)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	return server.resolve(ctx, service, strings.ToLower(funcName), args, false)
+}
+
+// parse decodes callStr, a call to the named service, into the name of the
+// function and its arguments.
+func (server *Server) parse(serviceName string, callStr []byte) (s *service, funcName string, args []interface{}, rpcErr *RPCError) {
+	if server.maxCall > 0 && len(callStr) > server.maxCall {
+		errStr := fmt.Sprintf("Call string too large: %d bytes, maximum %d", len(callStr), server.maxCall)
+		return nil, "", nil, &RPCError{ErrCode: int(RequestTooLargeError), ErrMsg: errStr}
+	}
+	if s, rpcErr = server.lookup(serviceName); rpcErr != nil {
+		return nil, "", nil, rpcErr
 	}
 
-	var data interface{}
-	parseErr := json.Unmarshal(callStr, &data)
+	data, parseErr := server.encoding().UnmarshalCall(callStr)
 	if parseErr != nil {
-		errStr = "Failed to parse call string:" + parseErr.Error()
-		errCode = ParseJSONError
-		log.Println(errStr)
-		res = &Result{ErrCode: errCode, ErrMsg: errStr}
-		retStr, _ = json.Marshal(*res)
-		return
+		return nil, "", nil, &RPCError{ErrCode: int(ParseJSONError), ErrMsg: "Failed to parse call string:" + server.parseDetails(parseErr, callStr)}
 	}
 
 	array, ok := data.([]interface{})
-	if !ok || len(array) == 0 {
-		errStr = "Invalid call string format"
-		errCode = ParseJSONError
-		log.Println(errStr)
-		res = &Result{ErrCode: errCode, ErrMsg: errStr}
-		retStr, _ = json.Marshal(*res)
-		return
+	if !ok {
+		return nil, "", nil, &RPCError{ErrCode: int(MalformedCallError), ErrMsg: "Invalid call string format: not an array"}
+	}
+	if len(array) == 0 {
+		return nil, "", nil, &RPCError{ErrCode: int(MalformedCallError), ErrMsg: "Invalid call string format: empty array"}
 	}
 
-	funcName, ok := array[0].(string)
+	funcName, ok = array[0].(string)
 	if !ok {
-		errStr = "Invalid call string format"
-		errCode = ParseJSONError
-		log.Println(errStr)
-		res = &Result{ErrCode: errCode, ErrMsg: errStr}
-		retStr, _ = json.Marshal(*res)
-		return
+		return nil, "", nil, &RPCError{ErrCode: int(MalformedCallError), ErrMsg: "Invalid call string format: function name is not a string"}
 	}
-	funcName = strings.ToLower(funcName)
+	return s, funcName, array[1:], nil
+}
 
-	method := service.method[funcName]
-	if method == nil {
-		errStr = "Cannot find function " + funcName
-		errCode = FunctionNotFoundError
-		log.Println(errStr)
-		res = &Result{ErrCode: errCode, ErrMsg: errStr}
-		retStr, _ = json.Marshal(*res)
-		return
+// callOptions returns the options object that may end the arguments of a
+// call, {"deadline_ms": n}. An object with other members is an argument.
+func callOptions(args []interface{}) (map[string]interface{}, bool) {
+	if len(args) == 0 {
+		return nil, false
 	}
+	opts, _ := args[len(args)-1].(map[string]interface{})
+	_, ok := opts["deadline_ms"]
+	return opts, ok && len(opts) == 1
+}
 
-	mtype := method.Type
-	// mtype.NumIn() includes the object itself
-	if mtype.NumIn() != len(array) {
-		errStr = "Parameters mismatch"
-		errCode = ParameterError
-		log.Println(errStr)
-		res = &Result{ErrCode: errCode, ErrMsg: errStr}
-		retStr, _ = json.Marshal(*res)
-		return
+// callDeadline returns the timeout set by the options object opts.
+func callDeadline(opts map[string]interface{}) (d time.Duration, err error) {
+	v := opts["deadline_ms"]
+	var ms float64
+	switch n := v.(type) {
+	case json.Number:
+		ms, err = n.Float64()
+	case float64:
+		ms = n
+	case int64:
+		ms = float64(n)
+	case uint64:
+		ms = float64(n)
+	default:
+		err = fmt.Errorf("deadline_ms is %T, not a number", v)
+	}
+	if err == nil && ms <= 0 {
+		err = fmt.Errorf("deadline_ms is %v, not positive", ms)
 	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
 
-	params := []reflect.Value{service.rcvr}
-	for i := 1; i < len(array); i++ {
-		params = append(params, reflect.ValueOf(array[i]))
+// release releases the resources of the call once it is done.
+func (c *preparedCall) release() {
+	if c.cancel != nil {
+		c.cancel()
 	}
-	errValue := method.Func.Call(params)
-	res = errValue[0].Interface().(*Result)
+}
 
-	retStr, _ = json.Marshal(*res)
-	return
+// resolve looks up function funcName of service and converts args for it.
+// local tells that args are Go values passed by CallLocal rather than
+// decoded from a call string. The options object that may end the decoded
+// arguments is removed if the function doesn't take it as an argument, and
+// its deadline applied to the context of the call, which is then released
+// by c.release.
+func (server *Server) resolve(ctx context.Context, service *service, funcName string, args []interface{}, local bool) (c *preparedCall, rpcErr *RPCError) {
+	// RegisterFunc may add functions to the service concurrently.
+	c = &preparedCall{ctx: ctx, funcName: funcName, args: args}
+	opts, hasOpts := callOptions(args)
+	hasOpts = hasOpts && !local
+	server.lock.RLock()
+	c.method = service.method[funcName]
+	overloads := service.overloads[funcName]
+	if len(overloads) > 0 {
+		c.method = overload(c.method, overloads, len(c.args))
+	}
+	if hasOpts && c.method != nil && !c.method.accepts(len(c.args)) {
+		if len(overloads) > 0 {
+			c.method = overload(c.method, overloads, len(c.args)-1)
+		}
+		hasOpts = c.method.accepts(len(c.args) - 1)
+	} else {
+		// Named arguments may be followed by options too.
+		hasOpts = hasOpts && c.method != nil && len(c.args) == 2 && namedOnly(c.args[0], c.method.paramNames)
+	}
+	disabled := service.disabled[funcName]
+	if c.method != nil {
+		// Disabling a function disables its aliases too.
+		disabled = disabled || service.disabled[c.method.name]
+	}
+	c.slots, c.failBusy = service.slots, service.failBusy
+	fallback := service.fallback
+	var paramNames []string
+	if c.method != nil {
+		paramNames = c.method.paramNames
+	}
+	c.interceptors = server.interceptors
+	cv := converter{funcs: server.converters, lenientBools: server.lenientBools, local: local}
+	var available []string
+	if c.method == nil && server.verbose {
+		available = service.methodNames()
+	}
+	server.lock.RUnlock()
+	if c.method == nil && fallback != nil {
+		c.method = fallbackMethod(funcName, fallback)
+	}
+	if c.method == nil {
+		errStr := "Cannot find function " + funcName
+		if server.verbose {
+			errStr += ", available functions: " + strings.Join(available, ", ")
+		}
+		return nil, &RPCError{ErrCode: int(FunctionNotFoundError), ErrMsg: errStr}
+	}
+	if disabled {
+		return nil, &RPCError{ErrCode: int(MethodDisabledError), ErrMsg: "Function " + funcName + " is disabled"}
+	}
+	if hasOpts {
+		d, err := callDeadline(opts)
+		if err != nil {
+			return nil, &RPCError{ErrCode: int(MalformedCallError), ErrMsg: "Invalid call string format: " + err.Error()}
+		}
+		c.args = c.args[:len(c.args)-1]
+		c.ctx, c.cancel = context.WithTimeout(ctx, d)
+		defer func() {
+			if rpcErr != nil {
+				c.cancel()
+			}
+		}()
+	}
+
+	if m, ok := singleObject(c.args); ok && paramNames != nil && !local {
+		args, err := namedArgs(paramNames, c.method.minArgs, m)
+		if err != nil {
+			return nil, &RPCError{ErrCode: int(ParameterError), ErrMsg: err.Error()}
+		}
+		c.args = args
+	}
+	if max := c.method.maxArgs; server.ignoreExtra && max >= 0 && len(c.args) > max {
+		c.args = c.args[:max]
+	}
+	params, err := c.method.params(c.ctx, service.rcvr, c.args, paramNames, cv)
+	if err != nil {
+		return nil, &RPCError{ErrCode: int(ParameterError), ErrMsg: err.Error()}
+	}
+	c.params = params
+	return c, nil
+}
+
+// namedOnly reports whether arg is an object whose members are all named in
+// names, as the named arguments of a call.
+func namedOnly(arg interface{}, names []string) bool {
+	m, ok := arg.(map[string]interface{})
+	if !ok || names == nil {
+		return false
+	}
+	for key := range m {
+		if !containsString(names, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// singleObject returns the object that args consists of, if any.
+func singleObject(args []interface{}) (map[string]interface{}, bool) {
+	if len(args) != 1 {
+		return nil, false
+	}
+	m, ok := args[0].(map[string]interface{})
+	return m, ok
+}
+
+// namedArgs returns the positional arguments for parameters named names from
+// the named arguments m, the parameters after the first min being optional.
+// Arguments after the last one given are omitted; others that are missing
+// are null, or omittedArg for optional parameters so that they get the zero
+// value too.
+func namedArgs(names []string, min int, m map[string]interface{}) ([]interface{}, error) {
+	args := make([]interface{}, len(names))
+	n, found := 0, 0
+	for i, name := range names {
+		if v, ok := m[name]; ok {
+			args[i] = v
+			n = i + 1
+			found++
+		} else if i >= min {
+			args[i] = omittedArg{}
+		}
+	}
+	if found < len(m) {
+		for key := range m {
+			if !containsString(names, key) {
+				return nil, errors.New("Unknown parameter " + key)
+			}
+		}
+	}
+	return args[:n], nil
+}
+
+// omittedArg stands for an optional argument left out of a call with named
+// arguments.
+type omittedArg struct{}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetParamNames names the parameters of function methodName of the named
+// service, omitting a context.Context parameter, so that it can also be
+// called with named arguments: a call string holding a single object, such
+// as ["get_repo", {"id": 1, "owner": "x"}], passes each member as the
+// argument of the parameter with that name. Variadic functions can't have
+// named parameters.
+func (server *Server) SetParamNames(serviceName, methodName string, names ...string) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	service := server.serviceMap[serviceName]
+	if service == nil {
+		return errors.New("searpc: service not defined: " + serviceName)
+	}
+	mt := service.method[strings.ToLower(methodName)]
+	if mt == nil {
+		return errors.New("searpc: function not defined: " + methodName)
+	}
+	if mt.variadic {
+		return errors.New("searpc: function " + methodName + " is variadic")
+	}
+	if len(names) != len(mt.argTypes) {
+		return fmt.Errorf("searpc: function %s has %d parameters, got %d names", methodName, len(mt.argTypes), len(names))
+	}
+	mt.paramNames = names
+	return nil
+}
+
+// parseDetails describes the error decoding callStr, giving the offset of
+// the offending byte when it is known and, with verbose errors, the text
+// around it.
+func (server *Server) parseDetails(err error, callStr []byte) string {
+	offset := int64(-1)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var trailingErr *trailingDataError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	case errors.As(err, &trailingErr):
+		offset = trailingErr.Offset
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// The call string is truncated.
+		offset = int64(len(callStr))
+	}
+	if offset < 0 {
+		return err.Error()
+	}
+	str := fmt.Sprintf("%v at offset %d", err, offset)
+	if server.verbose {
+		start, end := offset-16, offset+16
+		if start < 0 {
+			start = 0
+		}
+		if end > int64(len(callStr)) {
+			end = int64(len(callStr))
+		}
+		str += fmt.Sprintf(" near %q", callStr[start:end])
+	}
+	return str
+}
+
+// nfixed returns the number of parameters of the method that are not
+// variadic.
+func (mtype *methodType) nfixed() int {
+	if mtype.variadic {
+		// The last parameter collects any number of trailing arguments.
+		return len(mtype.argTypes) - 1
+	}
+	return len(mtype.argTypes)
+}
+
+// setOptional makes the last n fixed parameters of the method optional, and
+// computes the numbers of arguments the method accepts so that calls only
+// compare them. n is capped at the number of fixed parameters.
+func (mtype *methodType) setOptional(n int) {
+	nfixed := mtype.nfixed()
+	if n > nfixed {
+		n = nfixed
+	} else if n < 0 {
+		n = 0
+	}
+	mtype.optional = n
+	mtype.minArgs = nfixed - n
+	mtype.maxArgs = nfixed
+	if mtype.variadic {
+		mtype.maxArgs = -1
+	}
+}
+
+// accepts reports whether the method can be called with n arguments.
+func (mtype *methodType) accepts(n int) bool {
+	return n >= mtype.minArgs && (n <= mtype.maxArgs || mtype.maxArgs < 0)
+}
+
+// params builds the arguments for calling the method on rcvr from the
+// decoded arguments of a call string, converted by cv. Errors give the
+// 0-based index of the argument at fault, and its name if the parameters
+// are named by names. The returned slice
+// comes from the pool of the method; it must be given back with putParams
+// once the call is done.
+func (mtype *methodType) params(ctx context.Context, rcvr reflect.Value, args []interface{}, names []string, cv converter) (*[]reflect.Value, error) {
+	if n := len(args); n < mtype.minArgs {
+		return nil, fmt.Errorf("Parameters mismatch: %s of type %s is missing", argName(n, names), mtype.argTypes[n])
+	} else if !mtype.accepts(n) {
+		return nil, fmt.Errorf("Parameters mismatch: %s is extra, expected at most %d arguments", argName(mtype.maxArgs, names), mtype.maxArgs)
+	}
+	nfixed := mtype.nfixed()
+	n := len(args)
+	if n < nfixed {
+		n = nfixed
+	}
+	p, _ := mtype.pool.Get().(*[]reflect.Value)
+	if p == nil || cap(*p) < n+2 {
+		s := make([]reflect.Value, 0, n+2)
+		p = &s
+	}
+	params := (*p)[:0]
+	if !mtype.function {
+		params = append(params, rcvr)
+	}
+	if mtype.hasCtx {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		params = append(params, reflect.ValueOf(ctx))
+	}
+	for i, arg := range args {
+		var typ reflect.Type
+		if i < nfixed {
+			typ = mtype.argTypes[i]
+		} else {
+			typ = mtype.argTypes[nfixed].Elem()
+		}
+		if _, ok := arg.(omittedArg); ok {
+			params = append(params, reflect.Zero(typ))
+			continue
+		}
+		param, err := cv.convert(arg, typ)
+		if err != nil {
+			*p = params
+			mtype.putParams(p)
+			return nil, fmt.Errorf("%s: %v", argName(i, names), err)
+		}
+		params = append(params, param)
+	}
+	// Missing optional arguments get the zero value.
+	for i := len(args); i < nfixed; i++ {
+		params = append(params, reflect.Zero(mtype.argTypes[i]))
+	}
+	*p = params
+	return p, nil
+}
+
+// argName names argument i in errors.
+func argName(i int, names []string) string {
+	if i < len(names) {
+		return fmt.Sprintf("argument %d (%s)", i, names[i])
+	}
+	return "argument " + strconv.Itoa(i)
+}
+
+// putParams gives params back to the pool of the method, cleared so that
+// the pool doesn't keep the arguments alive.
+func (mtype *methodType) putParams(p *[]reflect.Value) {
+	params := *p
+	for i := range params {
+		params[i] = reflect.Value{}
+	}
+	*p = params[:0]
+	mtype.pool.Put(p)
 }
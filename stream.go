@@ -0,0 +1,123 @@
+package searpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// CallStream reads newline-delimited call strings from r, invokes each on the
+// named service, as Call does, and writes their results to w, one per line,
+// in the same order. Blank lines are skipped; any other line that isn't a
+// valid call gets an error result. It returns nil when r reaches EOF, or the
+// first error reading r or writing w. Results are expected not to contain
+// newlines, which holds with JSONEncoding. Lines longer than the size set by
+// SetMaxCallSize are not kept in memory: they get a RequestTooLargeError
+// result.
+func (server *Server) CallStream(serviceName string, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		line, n, err := readLine(br, server.maxCall)
+		var retStr []byte
+		if n > len(line) {
+			res, _ := server.failure(RequestTooLargeError, fmt.Sprintf("Call string too large: %d bytes, maximum %d", n, server.maxCall))
+			retStr = server.encode(res)
+		} else if line = bytes.TrimSpace(line); len(line) > 0 {
+			retStr = server.Call(serviceName, line)
+		}
+		if retStr != nil {
+			bw.Write(retStr)
+			bw.WriteByte('\n')
+			// Flush each result, the other end may wait for it
+			// before sending the next call.
+			if ferr := bw.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLine reads a line from br, of n bytes without the newline, keeping
+// only about max of them if max > 0: n > len(line) tells that the line was
+// cut.
+func readLine(br *bufio.Reader, max int) (line []byte, n int, err error) {
+	for {
+		var chunk []byte
+		chunk, err = br.ReadSlice('\n')
+		n += len(chunk)
+		if max <= 0 || len(line) <= max {
+			line = append(line, chunk...)
+		}
+		if err == nil {
+			return line, n - 1, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return line, n, err
+		}
+	}
+}
+
+// namedPipeRequest is the request of a libsearpc named pipe client, naming
+// the service called.
+type namedPipeRequest struct {
+	Service string  `json:"service"`
+	Request *string `json:"request"`
+}
+
+// ServePipe serves calls to server over conn with the framing of libsearpc
+// named pipes: each request, and each result written back, is preceded by
+// its length in bytes as a 4-byte little-endian integer. A request is a JSON
+// object, {"service": ..., "request": ...}, holding the call string and the
+// service to call it on; raw call strings are accepted too, and are called
+// on serviceName, as are requests without a service. Calls are served one
+// at a time, in order. It returns nil when conn reaches EOF between calls,
+// or the first error reading or writing conn, including a request longer
+// than the size set by SetMaxCallSize.
+func ServePipe(server *Server, serviceName string, conn io.ReadWriter) error {
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.LittleEndian.Uint32(header[:])
+		if server.maxCall > 0 && int64(n) > int64(server.maxCall) {
+			// Don't read it, the other end may be talking nonsense.
+			return fmt.Errorf("searpc.ServePipe: call of %d bytes, maximum %d", n, server.maxCall)
+		}
+		callStr := make([]byte, n)
+		if _, err := io.ReadFull(conn, callStr); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		sname := serviceName
+		var req namedPipeRequest
+		if json.Unmarshal(callStr, &req) == nil && req.Request != nil {
+			callStr = []byte(*req.Request)
+			if req.Service != "" {
+				sname = req.Service
+			}
+		}
+		retStr := server.Call(sname, callStr)
+		frame := make([]byte, 4+len(retStr))
+		binary.LittleEndian.PutUint32(frame, uint32(len(retStr)))
+		copy(frame[4:], retStr)
+		if _, err := conn.Write(frame); err != nil {
+			return err
+		}
+	}
+}